@@ -0,0 +1,89 @@
+// Command jwtkeys manages the keys in JWT_KEYS_DIR.
+//
+//	jwtkeys rotate [-alg EdDSA|RS256]  add a key; it signs five minutes on
+//	jwtkeys list                       show the keys, newest last
+//	jwtkeys prune [-after 1h]          remove keys replaced longer ago
+//
+// A replaced key keeps verifying tokens until it is pruned, so wait at
+// least ACCESS_TOKEN_TTL after a rotation before pruning. The server picks
+// up changes within a minute.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/keys"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	godotenv.Load(".env.local")
+	if len(os.Args) < 2 {
+		usage()
+	}
+	dir := os.Getenv("JWT_KEYS_DIR")
+	if dir == "" {
+		fail(fmt.Errorf("JWT_KEYS_DIR is not set"))
+	}
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	switch os.Args[1] {
+	case "rotate":
+		alg := flags.String("alg", keys.EdDSA, "signing algorithm, EdDSA or RS256")
+		flags.Parse(os.Args[2:])
+		key, err := keys.Generate(*alg)
+		if err != nil {
+			fail(err)
+		}
+		if err := keys.Write(dir, key); err != nil {
+			fail(err)
+		}
+		fmt.Println(key.ID)
+	case "list":
+		flags.Parse(os.Args[2:])
+		list, err := keys.ReadDir(dir)
+		if err != nil {
+			fail(err)
+		}
+		current := keys.SigningKey(list)
+		for _, key := range list {
+			state := "verifying"
+			if key == current {
+				state = "signing"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", key.ID, key.Method.Alg(), key.Created.Format(time.RFC3339), state)
+		}
+	case "prune":
+		after := flags.Duration("after", time.Hour, "how long a replaced key keeps verifying")
+		flags.Parse(os.Args[2:])
+		list, err := keys.ReadDir(dir)
+		if err != nil {
+			fail(err)
+		}
+		// A key was replaced once the next one started signing.
+		for i := 0; i+1 < len(list); i++ {
+			if time.Since(list[i+1].Created) < keys.PublishDelay+*after {
+				continue
+			}
+			if err := keys.Remove(dir, list[i].ID); err != nil {
+				fail(err)
+			}
+			fmt.Println("removed", list[i].ID)
+		}
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: jwtkeys rotate [-alg EdDSA|RS256] | list | prune [-after 1h]")
+	os.Exit(2)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "jwtkeys:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	t "github.com/SourishBeast7/Glooo/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Operations on Blobs Collection
+
+// A blob still marked as being deleted after this long was left behind by
+// a deletion that never finished.
+const staleBlobDeletion = 10 * time.Minute
+
+// ErrBlobDeleting is returned for a blob whose file is being deleted. The
+// caller can retry once the deletion is done.
+var ErrBlobDeleting = errors.New("blob is being deleted")
+
+// RetainBlob adds owner to the references of the blob stored under
+// blob.Key, creating the record if needed. It reports whether the record
+// existed; the file is only known to be stored when it is also Ready.
+func (s *Store) RetainBlob(blob *t.Blob, owner string) (*t.Blob, bool, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"hash":      blob.Hash,
+			"mime":      blob.Mime,
+			"size":      blob.Size,
+			"url":       blob.URL,
+			"createdat": time.Now().Format("2006-01-02 15:04:05"),
+		},
+		"$addToSet": bson.M{"refs": owner},
+	}
+	for range 2 {
+		// A record being deleted does not match, so the upsert runs into
+		// it instead of adding a reference the deletion would ignore.
+		res := s.blobsColl.FindOneAndUpdate(ctx, bson.M{
+			"_id":        blob.Key,
+			"deletingat": bson.M{"$exists": false},
+		}, update, opts)
+		existing := new(t.Blob)
+		err := res.Decode(existing)
+		if err == mongo.ErrNoDocuments {
+			return blob, false, nil
+		}
+		if err == nil {
+			return existing, true, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, false, err
+		}
+		gone, err := s.blobsColl.DeleteOne(ctx, bson.M{
+			"_id":        blob.Key,
+			"deletingat": bson.M{"$lt": time.Now().Add(-staleBlobDeletion)},
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		if gone.DeletedCount == 0 {
+			break
+		}
+	}
+	return nil, false, ErrBlobDeleting
+}
+
+// MarkBlobReady records that a blob was uploaded and where it can be
+// found.
+func (s *Store) MarkBlobReady(key, url string) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.blobsColl.UpdateByID(ctx, key, bson.M{
+		"$set": bson.M{"url": url, "ready": true},
+	})
+	return err
+}
+
+// AddBlobRef adds owner to the references of a blob that already has a
+// record. Files stored before reference counting, and ones being deleted,
+// are left alone.
+func (s *Store) AddBlobRef(key, owner string) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.blobsColl.UpdateOne(ctx, bson.M{
+		"_id":        key,
+		"deletingat": bson.M{"$exists": false},
+	}, bson.M{
+		"$addToSet": bson.M{"refs": owner},
+	})
+	return err
+}
+
+// ReleaseBlob drops owner from the references of the blob under key. It
+// reports true when that was the last reference, meaning the file itself
+// should be deleted; the record is then marked as being deleted, so that
+// nobody refers to the file again, until ForgetBlob removes it. Files
+// stored before reference counting have no record and are never reported.
+func (s *Store) ReleaseBlob(key, owner string) (bool, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	if _, err := s.blobsColl.UpdateByID(ctx, key, bson.M{
+		"$pull": bson.M{"refs": owner},
+	}); err != nil {
+		return false, err
+	}
+	res, err := s.blobsColl.UpdateOne(ctx, bson.M{
+		"_id":        key,
+		"refs":       bson.M{"$size": 0},
+		"deletingat": bson.M{"$exists": false},
+	}, bson.M{
+		"$set": bson.M{"deletingat": time.Now()},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// ForgetBlob removes the record of a blob whose file was deleted.
+func (s *Store) ForgetBlob(key string) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.blobsColl.DeleteOne(ctx, bson.M{
+		"_id":        key,
+		"deletingat": bson.M{"$exists": true},
+	})
+	return err
+}
+
+// Operations on Blobs Collection - end
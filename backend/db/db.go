@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	t "github.com/SourishBeast7/Glooo/types"
@@ -18,6 +19,15 @@ type Store struct {
 	userColl     *mongo.Collection
 	chatsColl    *mongo.Collection
 	messagesColl *mongo.Collection
+	uploadsColl  *mongo.Collection
+	blobsColl    *mongo.Collection
+	tokensColl   *mongo.Collection
+	revokedColl  *mongo.Collection
+	sessionsColl *mongo.Collection
+	emailColl    *mongo.Collection
+	loginColl    *mongo.Collection
+	passkeyColl  *mongo.Collection
+	oidcColl     *mongo.Collection
 }
 
 type MyError struct {
@@ -36,6 +46,34 @@ func UserExistsError() error {
 	}
 }
 
+func TooManyReactionsError() error {
+	return &MyError{
+		Code:    409,
+		Message: "Too Many Reactions On Message",
+	}
+}
+
+func AlreadyPinnedError() error {
+	return &MyError{
+		Code:    409,
+		Message: "Message Already Pinned",
+	}
+}
+
+func TooManyPinsError() error {
+	return &MyError{
+		Code:    409,
+		Message: "Too Many Pinned Messages",
+	}
+}
+
+func MessageNotFoundError() error {
+	return &MyError{
+		Code:    404,
+		Message: "Message Not Found",
+	}
+}
+
 func logError(err error) {
 	log.Printf("%+v", err)
 }
@@ -44,52 +82,137 @@ func genContext() (context.Context, context.CancelFunc) {
 	return context.WithTimeout(context.Background(), 10*time.Second)
 }
 
-func ConnectMongo() *Store {
+func ConnectMongo() (*Store, error) {
 	mongoURI := "mongodb://localhost:27017/"
 	if mongoURI == "" {
 		log.Fatal("❌ MONGO_URI not set in environment")
 	}
+	store, err := Connect(mongoURI, "real")
+	if err != nil {
+		return nil, err
+	}
+	log.Println("✅ Connected to MongoDB")
+	return store, nil
+}
 
-	clientOptions := options.Client().ApplyURI(mongoURI)
-
+// Connect opens the named database at uri. The store is usable even when
+// the ping fails, as the driver keeps trying to reach the server.
+func Connect(uri, database string) (*Store, error) {
 	ctx, cancel := genContext()
 	defer cancel()
 
-	client, err := mongo.Connect(ctx, clientOptions)
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
 	if err != nil {
-		log.Printf("❌ Failed to connect to MongoDB: %s", err.Error())
+		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
+	}
+	d := client.Database(database)
+	store := &Store{
+		userColl:     d.Collection("users"),
+		chatsColl:    d.Collection("chats"),
+		messagesColl: d.Collection("messages"),
+		uploadsColl:  d.Collection("uploads"),
+		blobsColl:    d.Collection("blobs"),
+		tokensColl:   d.Collection("refresh_tokens"),
+		revokedColl:  d.Collection("revoked_sessions"),
+		sessionsColl: d.Collection("sessions"),
+		emailColl:    d.Collection("email_tokens"),
+		loginColl:    d.Collection("login_challenges"),
+		passkeyColl:  d.Collection("passkey_ceremonies"),
+		oidcColl:     d.Collection("oidc_states"),
 	}
 
 	// Verify the connection
 	if err := client.Ping(ctx, nil); err != nil {
-		log.Printf("❌ MongoDB ping failed: %s", err.Error())
+		return store, fmt.Errorf("MongoDB ping failed: %w", err)
+	}
+	if err := store.indexEmails(ctx); err != nil {
+		return store, fmt.Errorf("indexing user emails failed: %w", err)
 	}
+	return store, nil
+}
 
-	log.Println("✅ Connected to MongoDB")
-	return &Store{
-		userColl:     client.Database("real").Collection("users"),
-		chatsColl:    client.Database("real").Collection("chats"),
-		messagesColl: client.Database("real").Collection("messages"),
+// NormalizeEmail is the form addresses are stored and looked up in, so
+// that one address in different case is one account.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// indexEmails lowercases addresses stored before they were normalized and
+// makes them unique. It fails when two accounts differ only by case; one
+// of them has to be merged or removed by hand.
+func (s *Store) indexEmails(ctx context.Context) error {
+	cursor, err := s.userColl.Find(ctx, bson.M{"email": bson.M{"$regex": "[A-Z]"}},
+		options.Find().SetProjection(bson.M{"email": 1}))
+	if err != nil {
+		return err
+	}
+	var users []struct {
+		ID    primitive.ObjectID `bson:"_id"`
+		Email string             `bson:"email"`
+	}
+	if err := cursor.All(ctx, &users); err != nil {
+		return err
 	}
+	for _, user := range users {
+		_, err := s.userColl.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{
+			"$set": bson.M{"email": NormalizeEmail(user.Email)},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = s.userColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// DropDatabase deletes every collection of the store and disconnects. It
+// is meant for throwaway test databases.
+func (s *Store) DropDatabase() error {
+	ctx, cancel := genContext()
+	defer cancel()
+	d := s.userColl.Database()
+	if err := d.Drop(ctx); err != nil {
+		return err
+	}
+	return d.Client().Disconnect(ctx)
 }
 
 // Operations on User Collections
 
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
 func (s *Store) AddUser(user *t.MongoUser) (map[string]any, error) {
 	ctx, cancel := genContext()
 	errmap := map[string]any{
 		"message": "An Error Occured",
 	}
 	defer cancel()
-	hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-	if err != nil {
-		return errmap, err
+	// Accounts made through a login provider have no password until one
+	// is set with a reset; an empty hash matches no password.
+	if user.Password != "" {
+		hash, err := hashPassword(user.Password)
+		if err != nil {
+			return errmap, err
+		}
+		user.Password = hash
 	}
-	user.Password = string(hash)
+	user.Email = NormalizeEmail(user.Email)
 	user.Chats = []primitive.ObjectID{}
 	now := time.Now()
 	user.CreatedAt = now.Format("2006-01-02 15:04:05")
 	_, e := s.userColl.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(e) {
+		return errmap, UserExistsError()
+	}
 	if e != nil {
 		return errmap, e
 	}
@@ -102,7 +225,7 @@ func (s *Store) AddUser(user *t.MongoUser) (map[string]any, error) {
 func (s *Store) FindUserByEmail(email string) (*t.MongoUser, error) {
 	ctx, cancel := genContext()
 	defer cancel()
-	filter := bson.M{"email": email}
+	filter := bson.M{"email": NormalizeEmail(email)}
 	res := s.userColl.FindOne(ctx, filter)
 	user := new(t.MongoUser)
 	if err := res.Decode(user); err != nil {
@@ -123,14 +246,27 @@ func (s *Store) FindUserById(id primitive.ObjectID) (*t.MongoUser, error) {
 	return user, nil
 }
 
+func (s *Store) FindUsersByIds(ids []primitive.ObjectID) ([]t.MongoUser, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	filter := bson.M{"_id": bson.M{"$in": ids}}
+	res, err := s.userColl.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]t.MongoUser, 0, len(ids))
+	if err := res.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
 func (s *Store) UserAlreadyExists(email string) bool {
 	ctx, cancel := genContext()
 	defer cancel()
-	filter := bson.M(map[string]any{"email": email})
+	filter := bson.M(map[string]any{"email": NormalizeEmail(email)})
 	res := s.userColl.FindOne(ctx, filter)
-	user := new(t.MongoUser)
-	res.Decode(user)
-	return (user != nil)
+	return res.Err() == nil
 }
 
 func (s *Store) AuthenticateUser(email string, password string) (*t.MongoUser, error) {
@@ -167,12 +303,123 @@ func (s *Store) UpdateUserDetails(id primitive.ObjectID, field string, value any
 	return nil
 }
 
+func (s *Store) SetChatMuted(userId, chatId primitive.ObjectID, muted bool) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	op := "$pull"
+	if muted {
+		op = "$addToSet"
+	}
+	_, err := s.userColl.UpdateByID(ctx, userId, bson.M{
+		op: bson.M{"muted": chatId},
+	})
+	return err
+}
+
+// SetUserAvatar replaces the profile picture of a user.
+func (s *Store) SetUserAvatar(id primitive.ObjectID, avatar *t.Avatar) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.userColl.UpdateByID(ctx, id, bson.M{
+		"$set": bson.M{
+			"pfp":            avatar.URL,
+			"pfpsizes":       avatar.Sizes,
+			"pfpgenerated":   avatar.Generated,
+			"pfpplaceholder": avatar.Placeholder,
+		},
+	})
+	return err
+}
+
+// FindUserByIdentity finds the user an account at a login provider is
+// linked to.
+func (s *Store) FindUserByIdentity(provider, subject string) (*t.MongoUser, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	filter := bson.M{"identities": bson.M{"$elemMatch": bson.M{
+		"provider": provider,
+		"subject":  subject,
+	}}}
+	res := s.userColl.FindOne(ctx, filter)
+	user := new(t.MongoUser)
+	if err := res.Decode(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// AddIdentity links an account at a login provider to a user.
+func (s *Store) AddIdentity(userId primitive.ObjectID, identity *t.Identity) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.userColl.UpdateByID(ctx, userId, bson.M{
+		"$push": bson.M{"identities": identity},
+	})
+	return err
+}
+
+// SetUserPassword replaces the password of a user.
+func (s *Store) SetUserPassword(id primitive.ObjectID, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err = s.userColl.UpdateByID(ctx, id, bson.M{
+		"$set": bson.M{"password": hash},
+	})
+	return err
+}
+
+// MarkUserVerified lifts the limits on a user whose address was
+// confirmed.
+func (s *Store) MarkUserVerified(id primitive.ObjectID) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.userColl.UpdateByID(ctx, id, bson.M{
+		"$unset": bson.M{"unverified": ""},
+	})
+	return err
+}
+
+// ClaimUnverifiedUser hands an unverified account to whoever proved they
+// own its address: the password, second factor, passkeys and login
+// identities it was set up with are dropped, and the name and picture are
+// replaced, since whoever signed up never showed they own the address. It
+// reports false when the account was verified already.
+func (s *Store) ClaimUnverifiedUser(id primitive.ObjectID, name string, avatar *t.Avatar) (bool, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.userColl.UpdateOne(ctx, bson.M{
+		"_id":        id,
+		"unverified": true,
+	}, bson.M{
+		"$set": bson.M{
+			"name":           name,
+			"pfp":            avatar.URL,
+			"pfpsizes":       avatar.Sizes,
+			"pfpgenerated":   avatar.Generated,
+			"pfpplaceholder": avatar.Placeholder,
+		},
+		"$unset": bson.M{
+			"unverified": "",
+			"password":   "",
+			"twofactor":  "",
+			"passkeys":   "",
+			"identities": "",
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
 // Operations on User Collections - end
 // Operations on Chats Collections
 
 func (s *Store) CreateChat(userIds ...primitive.ObjectID) (primitive.ObjectID, bool) {
-	ctx, cancel := genContext()
-	defer cancel()
 	chat := new(t.Chats)
 	chat.Participants = userIds
 	n := primitive.NilObjectID
@@ -185,6 +432,24 @@ func (s *Store) CreateChat(userIds ...primitive.ObjectID) (primitive.ObjectID, b
 		chat.Name = to.Name
 		chat.Group = false
 	}
+	return s.insertChat(chat)
+}
+
+// CreateGroupChat creates a named group with admin as its first participant
+// and only administrator.
+func (s *Store) CreateGroupChat(name string, admin primitive.ObjectID, members ...primitive.ObjectID) (primitive.ObjectID, bool) {
+	chat := new(t.Chats)
+	chat.Name = name
+	chat.Group = true
+	chat.Participants = append([]primitive.ObjectID{admin}, members...)
+	chat.Admins = []primitive.ObjectID{admin}
+	return s.insertChat(chat)
+}
+
+func (s *Store) insertChat(chat *t.Chats) (primitive.ObjectID, bool) {
+	ctx, cancel := genContext()
+	defer cancel()
+	n := primitive.NilObjectID
 	seen := make(map[primitive.ObjectID]bool)
 	for _, us := range chat.Participants {
 		if seen[us] {
@@ -194,15 +459,15 @@ func (s *Store) CreateChat(userIds ...primitive.ObjectID) (primitive.ObjectID, b
 	}
 	chat.Messages = make([]primitive.ObjectID, 0)
 	res, err := s.chatsColl.InsertOne(ctx, chat)
-	chatId, ok := res.InsertedID.(primitive.ObjectID)
-	if !ok {
-		return n, false
-	}
 	if err != nil {
 		log.Println(err.Error())
 		return n, false
 	}
-	for _, id := range userIds {
+	chatId, ok := res.InsertedID.(primitive.ObjectID)
+	if !ok {
+		return n, false
+	}
+	for _, id := range chat.Participants {
 		user, err := s.FindUserById(id)
 		if err != nil {
 			log.Printf("%s", err.Error())
@@ -285,21 +550,129 @@ func (s *Store) FindChatByParticipants(ids ...primitive.ObjectID) *t.Chats {
 	return chat
 }
 
+// RemoveParticipant takes the user out of a group. When the last admin
+// leaves, the longest standing remaining member becomes admin.
+func (s *Store) RemoveParticipant(chatId, userId primitive.ObjectID) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.chatsColl.UpdateByID(ctx, chatId, bson.M{
+		"$pull": bson.M{
+			"participants": userId,
+			"admins":       userId,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.userColl.UpdateByID(ctx, userId, bson.M{
+		"$pull": bson.M{"chats": chatId},
+	})
+	if err != nil {
+		return err
+	}
+	chat, err := s.FindChatById(chatId)
+	if err != nil {
+		return err
+	}
+	if len(chat.Admins) == 0 && len(chat.Participants) > 0 {
+		_, err = s.chatsColl.UpdateByID(ctx, chatId, bson.M{
+			"$addToSet": bson.M{"admins": chat.Participants[0]},
+		})
+	}
+	return err
+}
+
+const MaxPinnedMessages = 5
+
+// PinMessage adds the message to the chat's pinned list unless it is already
+// there or the chat has MaxPinnedMessages pins.
+func (s *Store) PinMessage(chatId primitive.ObjectID, pin t.PinnedMessage) (*t.Chats, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	pin.PinnedAt = time.Now().Format("2006-01-02 15:04:05")
+	res, err := s.chatsColl.UpdateOne(ctx, bson.M{
+		"_id":              chatId,
+		"pinned.messageid": bson.M{"$ne": pin.MessageId},
+		fmt.Sprintf("pinned.%d", MaxPinnedMessages-1): bson.M{"$exists": false},
+	}, bson.M{
+		"$push": bson.M{"pinned": pin},
+	})
+	if err != nil {
+		return nil, err
+	}
+	chat, err := s.FindChatById(chatId)
+	if err != nil {
+		return nil, err
+	}
+	if res.ModifiedCount == 0 {
+		if chat.IsPinned(pin.MessageId) {
+			return nil, AlreadyPinnedError()
+		}
+		return nil, TooManyPinsError()
+	}
+	return chat, nil
+}
+
+func (s *Store) UnpinMessage(chatId, msgId primitive.ObjectID) (*t.Chats, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.chatsColl.UpdateOne(ctx, bson.M{"_id": chatId}, bson.M{
+		"$pull": bson.M{"pinned": bson.M{"messageid": msgId}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.FindChatById(chatId)
+}
+
+// SetChatAvatar replaces the avatar of a group and returns the updated chat.
+func (s *Store) SetChatAvatar(chatId primitive.ObjectID, avatar *t.Avatar) (*t.Chats, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	res := s.chatsColl.FindOneAndUpdate(ctx, bson.M{"_id": chatId}, bson.M{
+		"$set": bson.M{
+			"avatar":            avatar.URL,
+			"avatarsizes":       avatar.Sizes,
+			"avatargenerated":   avatar.Generated,
+			"avatarplaceholder": avatar.Placeholder,
+		},
+	}, opts)
+	chat := new(t.Chats)
+	if err := res.Decode(chat); err != nil {
+		return nil, err
+	}
+	return chat, nil
+}
+
 // Operations on Chats Collections - end
 
 // Operations on Message Collection
 
-// func (s *Store) AddMessages(message *t.Message, chatid primitive.ObjectID) bool {
-// 	ctx, cancel := genContext()
-// 	defer cancel()
-// 	now := time.Now()
-// 	message.ArrivalTime = now.Format("2006-01-02 15:04:05")
-// 	session, err := s.messagesColl.Database().Client().StartSession()
-// 	if err != nil {
-// 		log.Println(err.Error())
-// 		return false
-// 	}
-// }
+const quotePreviewLength = 100
+
+func (s *Store) AddMessage(message *t.Message) (primitive.ObjectID, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	n := primitive.NilObjectID
+	if message.Content == nil {
+		message.Content = t.TextMessageContent(message.Data)
+	}
+	message.ArrivalTime = time.Now().Format("2006-01-02 15:04:05")
+	res, err := s.messagesColl.InsertOne(ctx, message)
+	if err != nil {
+		return n, err
+	}
+	id, ok := res.InsertedID.(primitive.ObjectID)
+	if !ok {
+		return n, fmt.Errorf("unexpected message id %v", res.InsertedID)
+	}
+	message.ID = id
+	if !s.InsertMessageInChat(message.ChatId, id) {
+		return n, fmt.Errorf("could not add message %s to chat %s", id.Hex(), message.ChatId.Hex())
+	}
+	return id, nil
+}
 
 func (s *Store) FindMessagesById(id primitive.ObjectID) *t.Message {
 	ctx, cancel := genContext()
@@ -319,8 +692,13 @@ func (s *Store) FindMessagesById(id primitive.ObjectID) *t.Message {
 func (s *Store) FindMessagesByChatId(chatid string) ([]t.Message, bool) {
 	ctx, cancel := genContext()
 	defer cancel()
+	id, err := primitive.ObjectIDFromHex(chatid)
+	if err != nil {
+		log.Printf("FindMessagesByChatId Error :%v", err)
+		return nil, false
+	}
 	filter := bson.M{
-		"chatid": chatid,
+		"chatid": id,
 	}
 	res, err := s.messagesColl.Find(ctx, filter)
 	if err != nil {
@@ -332,9 +710,143 @@ func (s *Store) FindMessagesByChatId(chatid string) ([]t.Message, bool) {
 	if err != nil {
 		return nil, false
 	}
+	if err := s.attachQuotes(messages); err != nil {
+		log.Printf("FindMessagesByChatId Error :%v", err)
+	}
 	return messages, true
 }
 
+// attachQuotes fills in the quoted preview of every message that replies to
+// another one, looking all parents up in a single query.
+func (s *Store) attachQuotes(messages []t.Message) error {
+	ids := make([]primitive.ObjectID, 0)
+	for _, msg := range messages {
+		if msg.ReplyTo != nil {
+			ids = append(ids, *msg.ReplyTo)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.messagesColl.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	parents := make([]t.Message, 0)
+	if err := res.All(ctx, &parents); err != nil {
+		return err
+	}
+	quotes := make(map[primitive.ObjectID]*t.QuotedMessage, len(parents))
+	for _, p := range parents {
+		quotes[p.ID] = QuoteOf(&p)
+	}
+	for i := range messages {
+		if messages[i].ReplyTo != nil {
+			messages[i].Quote = quotes[*messages[i].ReplyTo]
+		}
+	}
+	return nil
+}
+
+// QuoteOf builds the preview of a message shown inside replies to it.
+func QuoteOf(message *t.Message) *t.QuotedMessage {
+	data := []rune(message.Data)
+	if len(data) > quotePreviewLength {
+		data = append(data[:quotePreviewLength], '…')
+	}
+	return &t.QuotedMessage{
+		ID:          message.ID,
+		From:        message.From,
+		Data:        string(data),
+		ArrivalTime: message.ArrivalTime,
+	}
+}
+
+// ForwardedCopy returns a copy of message ready to be sent to chatId by
+// from. The copy shares the original content but none of the per-chat state
+// such as replies or reactions.
+func ForwardedCopy(message *t.Message, chatId, from primitive.ObjectID) *t.Message {
+	fwd := *message
+	fwd.ID = primitive.NilObjectID
+	fwd.ChatId = chatId
+	fwd.From = from
+	fwd.To = primitive.NilObjectID
+	fwd.ReplyTo = nil
+	fwd.ThreadId = nil
+	fwd.ReadBy = nil
+	fwd.Reactions = nil
+	fwd.Quote = nil
+	fwd.Mentions = nil
+	fwd.MentionAll = false
+	fwd.Forwarded = true
+	fwd.Forwards = message.Forwards + 1
+	if message.Origin == nil {
+		fwd.Origin = &t.ForwardOrigin{
+			MessageId: message.ID,
+			ChatId:    message.ChatId,
+			From:      message.From,
+		}
+	}
+	return &fwd
+}
+
+// FindThread returns the root message and every reply posted under it, with
+// the number of replies the given user has not read yet.
+func (s *Store) FindThread(rootId, userId primitive.ObjectID) (*t.Thread, error) {
+	root := s.FindMessagesById(rootId)
+	if root == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	ctx, cancel := genContext()
+	defer cancel()
+	filter := bson.M{
+		"threadid": rootId,
+	}
+	opts := options.Find().SetSort(bson.M{"_id": 1})
+	res, err := s.messagesColl.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	replies := make([]t.Message, 0)
+	if err := res.All(ctx, &replies); err != nil {
+		return nil, err
+	}
+	if err := s.attachQuotes(replies); err != nil {
+		return nil, err
+	}
+	unread, err := s.messagesColl.CountDocuments(ctx, bson.M{
+		"threadid": rootId,
+		"from":     bson.M{"$ne": userId},
+		"readby":   bson.M{"$ne": userId},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &t.Thread{
+		Root:    root,
+		Replies: replies,
+		Unread:  unread,
+	}, nil
+}
+
+func (s *Store) MarkThreadRead(rootId, userId primitive.ObjectID) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	filter := bson.M{
+		"threadid": rootId,
+		"readby":   bson.M{"$ne": userId},
+	}
+	data := bson.M{
+		"$addToSet": bson.M{
+			"readby": userId,
+		},
+	}
+	_, err := s.messagesColl.UpdateMany(ctx, filter, data)
+	return err
+}
+
 func (s *Store) InsertMessageInChat(chatId, msgId primitive.ObjectID) bool {
 	ctx, cancel := genContext()
 	defer cancel()
@@ -355,3 +867,236 @@ func (s *Store) InsertMessageInChat(chatId, msgId primitive.ObjectID) bool {
 	}
 	return true
 }
+
+// DeleteMessage removes a message from its chat, including any pin of it.
+// Replies and forwarded copies stay.
+func (s *Store) DeleteMessage(message *t.Message) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	if _, err := s.messagesColl.DeleteOne(ctx, bson.M{"_id": message.ID}); err != nil {
+		return err
+	}
+	_, err := s.chatsColl.UpdateByID(ctx, message.ChatId, bson.M{
+		"$pull": bson.M{
+			"messages": message.ID,
+			"pinned":   bson.M{"messageid": message.ID},
+		},
+	})
+	return err
+}
+
+// FindMessageByAttachment returns the message in chatId carrying the
+// attachment. Forwarded copies share attachment ids, so the chat matters.
+func (s *Store) FindMessageByAttachment(chatId, attachmentId primitive.ObjectID) (*t.Message, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	filter := bson.M{
+		"chatid":         chatId,
+		"attachments.id": attachmentId,
+	}
+	res := s.messagesColl.FindOne(ctx, filter)
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
+	message := new(t.Message)
+	if err := res.Decode(message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// FindMessageIdsByAttachment returns the ids of every message carrying the
+// attachment, the original and its forwarded copies.
+func (s *Store) FindMessageIdsByAttachment(attachmentId primitive.ObjectID) ([]primitive.ObjectID, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	cursor, err := s.messagesColl.Find(ctx, bson.M{"attachments.id": attachmentId}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var messages []t.Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(messages))
+	for _, msg := range messages {
+		ids = append(ids, msg.ID)
+	}
+	return ids, nil
+}
+
+// SetAttachmentStatus records the scan result of an attachment on every
+// message carrying it.
+func (s *Store) SetAttachmentStatus(attachmentId primitive.ObjectID, status, threat string) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: bson.A{bson.M{"a.id": attachmentId}},
+	})
+	_, err := s.messagesColl.UpdateMany(ctx, bson.M{"attachments.id": attachmentId}, bson.M{
+		"$set": bson.M{
+			"attachments.$[a].status": status,
+			"attachments.$[a].threat": threat,
+		},
+	}, opts)
+	return err
+}
+
+const pendingScanBatch = 100
+
+// FindPendingScans returns messages sent before the given time that still
+// have attachments waiting for a scan.
+func (s *Store) FindPendingScans(before time.Time) ([]t.Message, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	filter := bson.M{
+		"attachments.status": t.AttachmentPending,
+		"_id":                bson.M{"$lt": primitive.NewObjectIDFromTimestamp(before)},
+	}
+	res, err := s.messagesColl.Find(ctx, filter, options.Find().SetLimit(pendingScanBatch))
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]t.Message, 0)
+	if err := res.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+const mentionsPageSize = 50
+
+// FindMentions returns the newest messages that mention the user, either by
+// name or through @all in one of their chats. Passing a message id as before
+// pages further back.
+func (s *Store) FindMentions(user *t.MongoUser, before primitive.ObjectID) ([]t.Message, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	// Only chats the user is still in count, so leaving a group also
+	// hides its mentions.
+	filter := bson.M{
+		"chatid": bson.M{"$in": user.Chats},
+		"$or": bson.A{
+			bson.M{"mentions.userid": user.ID},
+			bson.M{
+				"mentionall": true,
+				"from":       bson.M{"$ne": user.ID},
+			},
+		},
+	}
+	if !before.IsZero() {
+		filter["_id"] = bson.M{"$lt": before}
+	}
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(mentionsPageSize)
+	res, err := s.messagesColl.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]t.Message, 0)
+	if err := res.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	if err := s.attachQuotes(messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// Operations on Message Collection - end
+// Reactions
+
+const MaxReactionsPerMessage = 20
+
+// AddReaction records the user's emoji reaction on a message. A message can
+// carry at most MaxReactionsPerMessage distinct emojis.
+func (s *Store) AddReaction(msgId, userId primitive.ObjectID, emoji string) (*t.Message, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	for range 2 {
+		res, err := s.messagesColl.UpdateOne(ctx, bson.M{
+			"_id":             msgId,
+			"reactions.emoji": emoji,
+		}, bson.M{
+			"$addToSet": bson.M{"reactions.$.users": userId},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if res.MatchedCount == 1 {
+			return s.reactedMessage(msgId)
+		}
+		// The emoji is new on this message; only push it while there is room.
+		res, err = s.messagesColl.UpdateOne(ctx, bson.M{
+			"_id":             msgId,
+			"reactions.emoji": bson.M{"$ne": emoji},
+			fmt.Sprintf("reactions.%d", MaxReactionsPerMessage-1): bson.M{"$exists": false},
+		}, bson.M{
+			"$push": bson.M{"reactions": t.Reaction{
+				Emoji: emoji,
+				Users: []primitive.ObjectID{userId},
+			}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if res.MatchedCount == 1 {
+			return s.reactedMessage(msgId)
+		}
+		// Someone else added the same emoji in the meantime, in which case
+		// the next round joins it, the message is full, or it was deleted.
+		n, err := s.messagesColl.CountDocuments(ctx, bson.M{"_id": msgId, "reactions.emoji": emoji})
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, s.reactionRefused(ctx, msgId)
+		}
+	}
+	return nil, s.reactionRefused(ctx, msgId)
+}
+
+func (s *Store) RemoveReaction(msgId, userId primitive.ObjectID, emoji string) (*t.Message, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.messagesColl.UpdateOne(ctx, bson.M{
+		"_id":             msgId,
+		"reactions.emoji": emoji,
+	}, bson.M{
+		"$pull": bson.M{"reactions.$.users": userId},
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.messagesColl.UpdateOne(ctx, bson.M{"_id": msgId}, bson.M{
+		"$pull": bson.M{"reactions": bson.M{"users": bson.M{"$size": 0}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.reactedMessage(msgId)
+}
+
+// reactionRefused tells a full message from one that is gone.
+func (s *Store) reactionRefused(ctx context.Context, msgId primitive.ObjectID) error {
+	n, err := s.messagesColl.CountDocuments(ctx, bson.M{"_id": msgId})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return MessageNotFoundError()
+	}
+	return TooManyReactionsError()
+}
+
+// reactedMessage re-reads a message after a reaction changed, which fails
+// when the message was deleted in the meantime.
+func (s *Store) reactedMessage(msgId primitive.ObjectID) (*t.Message, error) {
+	msg := s.FindMessagesById(msgId)
+	if msg == nil {
+		return nil, MessageNotFoundError()
+	}
+	return msg, nil
+}
+
+// Reactions - end
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"time"
+
+	t "github.com/SourishBeast7/Glooo/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Operations on Email Tokens Collection
+
+func (s *Store) AddEmailToken(token *t.EmailToken) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.emailColl.InsertOne(ctx, token)
+	if err != nil {
+		return err
+	}
+	token.ID = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// ConsumeEmailToken looks up an unexpired token by its hash and deletes
+// it, so that it works only once.
+func (s *Store) ConsumeEmailToken(hash, purpose string) (*t.EmailToken, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res := s.emailColl.FindOneAndDelete(ctx, bson.M{
+		"hash":      hash,
+		"purpose":   purpose,
+		"expiresat": bson.M{"$gt": time.Now()},
+	})
+	token := new(t.EmailToken)
+	if err := res.Decode(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// CountEmailTokens counts the tokens sent to a user since the given time,
+// for throttling.
+func (s *Store) CountEmailTokens(userId primitive.ObjectID, purpose string, since time.Time) (int64, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	return s.emailColl.CountDocuments(ctx, bson.M{
+		"userid":    userId,
+		"purpose":   purpose,
+		"createdat": bson.M{"$gte": since},
+	})
+}
+
+func (s *Store) DeleteEmailTokens(userId primitive.ObjectID, purpose string) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.emailColl.DeleteMany(ctx, bson.M{
+		"userid":  userId,
+		"purpose": purpose,
+	})
+	return err
+}
+
+// Operations on Email Tokens Collection - end
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"time"
+
+	t "github.com/SourishBeast7/Glooo/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Operations on OIDC States Collection
+
+func (s *Store) AddOIDCState(state *t.OIDCState) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.oidcColl.InsertOne(ctx, state)
+	if err != nil {
+		return err
+	}
+	state.ID = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// ConsumeOIDCState looks up an unexpired login by the hash of its state
+// and deletes it, so that a provider's answer is taken only once.
+func (s *Store) ConsumeOIDCState(hash string) (*t.OIDCState, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res := s.oidcColl.FindOneAndDelete(ctx, bson.M{
+		"hash":      hash,
+		"expiresat": bson.M{"$gt": time.Now()},
+	})
+	state := new(t.OIDCState)
+	if err := res.Decode(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Operations on OIDC States Collection - end
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"time"
+
+	t "github.com/SourishBeast7/Glooo/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (s *Store) AddPasskey(userId primitive.ObjectID, passkey *t.Passkey) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.userColl.UpdateByID(ctx, userId, bson.M{
+		"$push": bson.M{"passkeys": passkey},
+	})
+	return err
+}
+
+// UsePasskey records a login with a passkey and its new signature counter.
+func (s *Store) UsePasskey(userId primitive.ObjectID, passkeyId []byte, signCount uint32) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.userColl.UpdateOne(ctx, bson.M{
+		"_id":         userId,
+		"passkeys.id": passkeyId,
+	}, bson.M{
+		"$set": bson.M{
+			"passkeys.$.signcount": signCount,
+			"passkeys.$.lastused":  time.Now(),
+		},
+	})
+	return err
+}
+
+// RemovePasskey deletes a passkey of a user. It reports false when the
+// user has no such passkey.
+func (s *Store) RemovePasskey(userId primitive.ObjectID, passkeyId []byte) (bool, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.userColl.UpdateByID(ctx, userId, bson.M{
+		"$pull": bson.M{"passkeys": bson.M{"id": passkeyId}},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// Operations on Passkey Ceremonies Collection
+
+func (s *Store) AddPasskeyCeremony(ceremony *t.PasskeyCeremony) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.passkeyColl.InsertOne(ctx, ceremony)
+	if err != nil {
+		return err
+	}
+	ceremony.ID = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// ConsumePasskeyCeremony looks up an unexpired ceremony by the hash of its
+// token and deletes it, so that every challenge is answered only once.
+func (s *Store) ConsumePasskeyCeremony(hash, purpose string) (*t.PasskeyCeremony, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res := s.passkeyColl.FindOneAndDelete(ctx, bson.M{
+		"hash":      hash,
+		"purpose":   purpose,
+		"expiresat": bson.M{"$gt": time.Now()},
+	})
+	ceremony := new(t.PasskeyCeremony)
+	if err := res.Decode(ceremony); err != nil {
+		return nil, err
+	}
+	return ceremony, nil
+}
+
+// Operations on Passkey Ceremonies Collection - end
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"time"
+
+	t "github.com/SourishBeast7/Glooo/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Operations on Sessions Collection
+
+func (s *Store) AddSession(session *t.Session) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.sessionsColl.InsertOne(ctx, session)
+	return err
+}
+
+// TouchSession records activity on a session from ip.
+func (s *Store) TouchSession(id primitive.ObjectID, ip string, at time.Time) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.sessionsColl.UpdateByID(ctx, id, bson.M{
+		"$set": bson.M{
+			"lastactive": at,
+			"ip":         ip,
+		},
+	})
+	return err
+}
+
+// ExtendSession moves the expiry of a session along with its newest
+// refresh token.
+func (s *Store) ExtendSession(id primitive.ObjectID, expiresAt time.Time) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.sessionsColl.UpdateByID(ctx, id, bson.M{
+		"$set": bson.M{"expiresat": expiresAt},
+	})
+	return err
+}
+
+func (s *Store) EndSession(id primitive.ObjectID) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.sessionsColl.UpdateByID(ctx, id, bson.M{
+		"$set": bson.M{"revoked": true},
+	})
+	return err
+}
+
+func (s *Store) FindSession(id primitive.ObjectID) (*t.Session, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res := s.sessionsColl.FindOne(ctx, bson.M{"_id": id})
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
+	session := new(t.Session)
+	if err := res.Decode(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// FindSessions returns the logins of a user that are still usable, most
+// recently active first.
+func (s *Store) FindSessions(userId primitive.ObjectID) ([]t.Session, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	filter := bson.M{
+		"userid":    userId,
+		"revoked":   false,
+		"expiresat": bson.M{"$gt": time.Now()},
+	}
+	res, err := s.sessionsColl.Find(ctx, filter, options.Find().SetSort(bson.M{"lastactive": -1}))
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]t.Session, 0)
+	if err := res.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Operations on Sessions Collection - end
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"time"
+
+	t "github.com/SourishBeast7/Glooo/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Operations on Refresh Tokens Collection
+
+func (s *Store) AddRefreshToken(token *t.RefreshToken) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.tokensColl.InsertOne(ctx, token)
+	if err != nil {
+		return err
+	}
+	token.ID = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func (s *Store) FindRefreshToken(hash string) (*t.RefreshToken, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res := s.tokensColl.FindOne(ctx, bson.M{"hash": hash})
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
+	token := new(t.RefreshToken)
+	if err := res.Decode(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// UseRefreshToken marks a token as exchanged. It reports false when the
+// token was already used or revoked, which for a refresh token means it is
+// being replayed.
+func (s *Store) UseRefreshToken(id primitive.ObjectID) (bool, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.tokensColl.UpdateOne(ctx, bson.M{
+		"_id":     id,
+		"used":    false,
+		"revoked": false,
+	}, bson.M{
+		"$set": bson.M{"used": true},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// RevokeTokenFamily stops every refresh token issued for one login.
+func (s *Store) RevokeTokenFamily(family primitive.ObjectID) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.tokensColl.UpdateMany(ctx, bson.M{"family": family}, bson.M{
+		"$set": bson.M{"revoked": true},
+	})
+	return err
+}
+
+// FindActiveFamilies returns the logins of a user whose refresh tokens can
+// still be used.
+func (s *Store) FindActiveFamilies(userId primitive.ObjectID) ([]primitive.ObjectID, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	values, err := s.tokensColl.Distinct(ctx, "family", bson.M{
+		"userid":    userId,
+		"revoked":   false,
+		"expiresat": bson.M{"$gt": time.Now()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	families := make([]primitive.ObjectID, 0, len(values))
+	for _, v := range values {
+		if id, ok := v.(primitive.ObjectID); ok {
+			families = append(families, id)
+		}
+	}
+	return families, nil
+}
+
+// Operations on Refresh Tokens Collection - end
+
+// Operations on Revoked Sessions Collection
+
+func (s *Store) RevokeSession(session *t.RevokedSession) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.revokedColl.ReplaceOne(ctx, bson.M{"_id": session.ID}, session, options.Replace().SetUpsert(true))
+	return err
+}
+
+// FindRevokedSession returns the revocation of a session, or nil when it
+// was never revoked or the revocation has run out.
+func (s *Store) FindRevokedSession(id primitive.ObjectID) (*t.RevokedSession, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res := s.revokedColl.FindOne(ctx, bson.M{
+		"_id":   id,
+		"until": bson.M{"$gt": time.Now()},
+	})
+	if err := res.Err(); err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	session := new(t.RevokedSession)
+	if err := res.Decode(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Operations on Revoked Sessions Collection - end
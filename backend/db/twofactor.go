@@ -0,0 +1,137 @@
+package db
+
+import (
+	"time"
+
+	t "github.com/SourishBeast7/Glooo/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SetPendingTOTP stores a secret being enrolled, without turning two
+// factor authentication on.
+func (s *Store) SetPendingTOTP(userId primitive.ObjectID, secret string) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.userColl.UpdateByID(ctx, userId, bson.M{
+		"$set": bson.M{"twofactor.pending": secret},
+	})
+	return err
+}
+
+// EnableTOTP turns on the pending secret, if it is still the one the
+// code was checked against.
+func (s *Store) EnableTOTP(userId primitive.ObjectID, secret string, step int64, recoveryCodes []string) (bool, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.userColl.UpdateOne(ctx, bson.M{
+		"_id":               userId,
+		"twofactor.pending": secret,
+	}, bson.M{
+		"$set": bson.M{"twofactor": t.TwoFactor{
+			Secret:        secret,
+			Enabled:       true,
+			LastStep:      step,
+			RecoveryCodes: recoveryCodes,
+		}},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+func (s *Store) DisableTOTP(userId primitive.ObjectID) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.userColl.UpdateByID(ctx, userId, bson.M{
+		"$unset": bson.M{"twofactor": ""},
+	})
+	return err
+}
+
+// UseTOTPStep records that a code of step was used. It reports false when
+// that or a later code was used already, which means the code is being
+// replayed.
+func (s *Store) UseTOTPStep(userId primitive.ObjectID, step int64) (bool, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.userColl.UpdateOne(ctx, bson.M{
+		"_id":                userId,
+		"twofactor.enabled":  true,
+		"twofactor.laststep": bson.M{"$lt": step},
+	}, bson.M{
+		"$set": bson.M{"twofactor.laststep": step},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// UseRecoveryCode strikes off a recovery code by its hash. It reports
+// false when there is no such unused code.
+func (s *Store) UseRecoveryCode(userId primitive.ObjectID, hash string) (bool, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.userColl.UpdateOne(ctx, bson.M{
+		"_id":                     userId,
+		"twofactor.enabled":       true,
+		"twofactor.recoverycodes": hash,
+	}, bson.M{
+		"$pull": bson.M{"twofactor.recoverycodes": hash},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// Operations on Login Challenges Collection
+
+func (s *Store) AddLoginChallenge(challenge *t.LoginChallenge) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.loginColl.InsertOne(ctx, challenge)
+	if err != nil {
+		return err
+	}
+	challenge.ID = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// AttemptLoginChallenge looks up an unexpired challenge by the hash of its
+// token and uses up one of its attempts, before the code is checked, so
+// that concurrent guesses cannot get past maxAttempts. A challenge out of
+// attempts is not found.
+func (s *Store) AttemptLoginChallenge(hash string, maxAttempts int) (*t.LoginChallenge, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res := s.loginColl.FindOneAndUpdate(ctx, bson.M{
+		"hash":      hash,
+		"expiresat": bson.M{"$gt": time.Now()},
+		"attempts":  bson.M{"$lt": maxAttempts},
+	}, bson.M{
+		"$inc": bson.M{"attempts": 1},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After))
+	challenge := new(t.LoginChallenge)
+	if err := res.Decode(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// DeleteLoginChallenge ends a challenge. It reports false when it was
+// already gone, so that a challenge completes only once.
+func (s *Store) DeleteLoginChallenge(id primitive.ObjectID) (bool, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.loginColl.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount == 1, nil
+}
+
+// Operations on Login Challenges Collection - end
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"time"
+
+	t "github.com/SourishBeast7/Glooo/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Operations on Uploads Collection
+
+func (s *Store) CreateUpload(upload *t.Upload) (primitive.ObjectID, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	upload.Offset = 0
+	upload.Chunks = []t.UploadChunk{}
+	res, err := s.uploadsColl.InsertOne(ctx, upload)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	upload.ID = res.InsertedID.(primitive.ObjectID)
+	return upload.ID, nil
+}
+
+func (s *Store) FindUpload(id primitive.ObjectID) (*t.Upload, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res := s.uploadsColl.FindOne(ctx, bson.M{"_id": id})
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
+	upload := new(t.Upload)
+	if err := res.Decode(upload); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// AppendUploadChunk records a stored chunk, but only if the upload is still
+// at the offset the chunk was written for. It reports false when another
+// request got there first.
+func (s *Store) AppendUploadChunk(id primitive.ObjectID, chunk t.UploadChunk) (bool, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.uploadsColl.UpdateOne(ctx, bson.M{
+		"_id":    id,
+		"offset": chunk.Offset,
+	}, bson.M{
+		"$set":  bson.M{"offset": chunk.Offset + chunk.Size},
+		"$push": bson.M{"chunks": chunk},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// CompleteUpload marks the upload as turned into a message and forgets its
+// chunks, which the caller deletes from storage.
+func (s *Store) CompleteUpload(id, messageId primitive.ObjectID) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	_, err := s.uploadsColl.UpdateByID(ctx, id, bson.M{
+		"$set": bson.M{
+			"messageid": messageId,
+			"chunks":    []t.UploadChunk{},
+		},
+	})
+	return err
+}
+
+func (s *Store) DeleteUpload(id primitive.ObjectID) error {
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.uploadsColl.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func (s *Store) FindExpiredUploads(now time.Time) ([]t.Upload, error) {
+	ctx, cancel := genContext()
+	defer cancel()
+	res, err := s.uploadsColl.Find(ctx, bson.M{"expiresat": bson.M{"$lt": now}})
+	if err != nil {
+		return nil, err
+	}
+	uploads := make([]t.Upload, 0)
+	if err := res.All(ctx, &uploads); err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+// Operations on Uploads Collection - end
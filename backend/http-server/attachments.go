@@ -0,0 +1,424 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/SourishBeast7/Glooo/media"
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	maxAttachmentSize  = 25 << 20
+	maxAttachmentFiles = 10
+)
+
+// Anything under these prefixes, plus the exact types below, may be sent.
+var (
+	allowedAttachmentPrefixes = []string{"image/", "audio/", "video/"}
+	allowedAttachmentTypes    = map[string]bool{
+		"application/pdf": true,
+		"application/zip": true,
+		"application/ogg": true,
+		"text/plain":      true,
+	}
+)
+
+func attachmentTypeAllowed(mimeType string) bool {
+	for _, prefix := range allowedAttachmentPrefixes {
+		if strings.HasPrefix(mimeType, prefix) {
+			return true
+		}
+	}
+	return allowedAttachmentTypes[mimeType]
+}
+
+// sniffMime detects the type from the file contents, falling back to the
+// extension only when the contents say nothing more specific.
+func sniffMime(file io.ReadSeeker, filename string) (string, error) {
+	head, err := peek(file)
+	if err != nil {
+		return "", err
+	}
+	detected, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if detected == "application/octet-stream" || detected == "application/zip" {
+		if byExt, _, err := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(filename))); err == nil {
+			return byExt, nil
+		}
+	}
+	return detected, nil
+}
+
+// wavDuration reads the length of a PCM wave file from its header.
+func wavDuration(file io.ReadSeeker) float64 {
+	defer file.Seek(0, io.SeekStart)
+	header := make([]byte, 44)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return 0
+	}
+	byteRate := binary.LittleEndian.Uint32(header[28:32])
+	dataSize := binary.LittleEndian.Uint32(header[40:44])
+	if string(header[36:40]) != "data" || byteRate == 0 {
+		return 0
+	}
+	return float64(dataSize) / float64(byteRate)
+}
+
+// attachmentMime decides the type a file is stored and served as. Only
+// images we can decode, and so strip of their metadata, stay images. Any
+// other image, e.g. HEIC or TIFF, or a file only named like an image, is
+// kept as a plain download, since it would still carry its EXIF and GPS
+// data.
+func attachmentMime(file io.ReadSeeker, filename string) (string, error) {
+	mimeType, err := sniffMime(file, filename)
+	if err != nil {
+		return "", err
+	}
+	if !attachmentTypeAllowed(mimeType) {
+		return "", fmt.Errorf("%s files cannot be sent", mimeType)
+	}
+	if strings.HasPrefix(mimeType, "image/") {
+		head, err := peek(file)
+		if err != nil {
+			return "", err
+		}
+		if !isImage(head) {
+			return "application/octet-stream", nil
+		}
+	}
+	return mimeType, nil
+}
+
+// storeAttachment checks, measures and uploads one file of the message
+// messageId. Files are named after their contents, so the same file sent
+// again is stored once. Size limits are up to the caller.
+func (s *Server) storeAttachment(ctx context.Context, messageId primitive.ObjectID, file io.ReadSeeker, filename string, duration float64) (*t.Attachment, error) {
+	mimeType, err := attachmentMime(file, filename)
+	if err != nil {
+		return nil, err
+	}
+	attachment := &t.Attachment{
+		ID:     primitive.NewObjectID(),
+		Name:   filepath.Base(filename),
+		Mime:   mimeType,
+		Status: t.AttachmentPending,
+	}
+	owner := messageRef(messageId)
+	prefix := "attachments/"
+
+	// Images we can decode are cleaned of metadata and resized; everything
+	// else is stored byte for byte.
+	if head, _ := peek(file); isImage(head) {
+		size, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if size > media.MaxSize {
+			return nil, media.ErrTooLarge
+		}
+		stored, err := s.storeImage(ctx, owner, prefix, file, media.AttachmentVariants, true)
+		if err != nil {
+			return nil, err
+		}
+		attachment.Mime = stored.Original.Mime
+		attachment.Size = int64(len(stored.Original.Data))
+		attachment.Hash = stored.Original.Hash
+		attachment.Width = stored.Original.Width
+		attachment.Height = stored.Original.Height
+		attachment.Variants = stored.Variants
+		attachment.Placeholder = stored.Placeholder
+		attachment.Path = stored.Path
+		return attachment, nil
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	attachment.Size = size
+	attachment.Hash = hex.EncodeToString(hash.Sum(nil))
+	switch {
+	case mimeType == "audio/wave" || mimeType == "audio/wav":
+		attachment.Duration = wavDuration(file)
+	case strings.HasPrefix(mimeType, "audio/") || strings.HasPrefix(mimeType, "video/"):
+		attachment.Duration = duration
+	}
+
+	ext := ""
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		ext = exts[0]
+	}
+	attachment.Path = prefix + attachment.Hash + ext
+	if _, err := s.putBlob(ctx, owner, attachment.Path, file, size, mimeType, attachment.Hash); err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+func isImage(head []byte) bool {
+	_, ok := media.IsImage(head)
+	return ok
+}
+
+// peek returns the first bytes of file and rewinds it.
+func peek(file io.ReadSeeker) ([]byte, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// attachmentContent describes the first attachment as the message content.
+func attachmentContent(attachment *t.Attachment, caption string) *t.MessageContent {
+	kind := t.KindFile
+	switch {
+	case strings.HasPrefix(attachment.Mime, "image/"):
+		kind = t.KindImage
+	case strings.HasPrefix(attachment.Mime, "audio/"):
+		kind = t.KindAudio
+	}
+	return &t.MessageContent{
+		Kind: kind,
+		Media: &t.MediaContent{
+			AttachmentId: &attachment.ID,
+			Name:         attachment.Name,
+			Mime:         attachment.Mime,
+			Size:         attachment.Size,
+			Width:        attachment.Width,
+			Height:       attachment.Height,
+			Duration:     attachment.Duration,
+			Caption:      caption,
+			Placeholder:  attachment.Placeholder,
+		},
+	}
+}
+
+// sendAttachments posts attachments stored for messageId to the chat as
+// that message. The files are released again when it cannot be sent.
+func (s *Server) sendAttachments(chat *t.Chats, userId, messageId primitive.ObjectID, attachments []t.Attachment, caption string) (*t.Message, error) {
+	message, err := s.addAttachmentMessage(chat, userId, messageId, attachments, caption)
+	if err != nil {
+		s.releaseBlobs(context.Background(), messageRef(messageId), attachmentPaths(attachments...)...)
+		return nil, err
+	}
+	s.emitMessage(chat, message)
+	scan := *message
+	scan.Attachments = append([]t.Attachment(nil), message.Attachments...)
+	go s.scanAttachments(&scan)
+	return message, nil
+}
+
+func (s *Server) addAttachmentMessage(chat *t.Chats, userId, messageId primitive.ObjectID, attachments []t.Attachment, caption string) (*t.Message, error) {
+	content := attachmentContent(&attachments[0], caption)
+	if err := content.Validate(); err != nil {
+		return nil, err
+	}
+	message := &t.Message{
+		ID:          messageId,
+		Data:        content.Summary(),
+		Content:     content,
+		Attachments: attachments,
+		From:        userId,
+		ChatId:      chat.ID,
+		To:          recipientOf(chat, userId),
+	}
+	if chat.Group && caption != "" {
+		participants, err := s.store.FindUsersByIds(chat.Participants)
+		if err != nil {
+			return nil, err
+		}
+		message.Mentions, message.MentionAll = parseMentions(message.Data, participants, userId)
+	}
+	if _, err := s.store.AddMessage(message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (s *Server) handleAttachmentRoutes(router *mux.Router) {
+	router.HandleFunc("/chat/{chatid}/attachments", m.VerifiedMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
+		chat, err := s.chatForUser(mux.Vars(r)["chatid"], userId)
+		if err != nil {
+			WriteJson(w, http.StatusForbidden, Response{
+				"err": "Chat Not Found",
+			})
+			return err
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentFiles*maxAttachmentSize+(1<<20))
+		if err := r.ParseMultipartForm(10 << 20); err != nil {
+			return WriteJson(w, http.StatusRequestEntityTooLarge, Response{
+				"err": err.Error(),
+			})
+		}
+		headers := r.MultipartForm.File["files"]
+		if len(headers) == 0 || len(headers) > maxAttachmentFiles {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": fmt.Sprintf("Send Between 1 And %d Files", maxAttachmentFiles),
+			})
+		}
+		caption := r.FormValue("caption")
+		duration, _ := strconv.ParseFloat(r.FormValue("duration"), 64)
+		if duration < 0 {
+			duration = 0
+		}
+
+		for _, header := range headers {
+			if header.Size > maxAttachmentSize {
+				return WriteJson(w, http.StatusRequestEntityTooLarge, Response{
+					"err": fmt.Sprintf("%s is larger than %d MB", header.Filename, maxAttachmentSize>>20),
+				})
+			}
+		}
+
+		messageId := primitive.NewObjectID()
+		attachments := make([]t.Attachment, 0, len(headers))
+		for _, header := range headers {
+			file, err := header.Open()
+			if err != nil {
+				s.releaseBlobs(r.Context(), messageRef(messageId), attachmentPaths(attachments...)...)
+				return err
+			}
+			attachment, err := s.storeAttachment(r.Context(), messageId, file, header.Filename, duration)
+			file.Close()
+			if err != nil {
+				s.releaseBlobs(r.Context(), messageRef(messageId), attachmentPaths(attachments...)...)
+				return WriteJson(w, http.StatusNotAcceptable, Response{
+					"err": err.Error(),
+				})
+			}
+			attachments = append(attachments, *attachment)
+		}
+
+		message, err := s.sendAttachments(chat, userId, messageId, attachments, caption)
+		if err != nil {
+			WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": err.Error(),
+			})
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+			"message": s.presentMessage(userId, message),
+		})
+	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/chat/{chatid}/attachments/{attid}", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
+		return s.serveChatAttachment(w, r, userId, mux.Vars(r)["chatid"], mux.Vars(r)["attid"])
+	}))).Methods(http.MethodGet)
+}
+
+// serveChatAttachment streams an attachment, or the variant named in the
+// query, to a participant of the chat.
+func (s *Server) serveChatAttachment(w http.ResponseWriter, r *http.Request, userId primitive.ObjectID, chatHex, attHex string) error {
+	chat, err := s.chatForUser(chatHex, userId)
+	if err != nil {
+		WriteJson(w, http.StatusForbidden, Response{
+			"err": "Chat Not Found",
+		})
+		return err
+	}
+	attId, err := primitive.ObjectIDFromHex(attHex)
+	if err != nil {
+		return WriteJson(w, http.StatusNotAcceptable, Response{
+			"err": err.Error(),
+		})
+	}
+	message, err := s.store.FindMessageByAttachment(chat.ID, attId)
+	if err != nil {
+		return WriteJson(w, http.StatusNotFound, Response{
+			"err": "Attachment Not Found",
+		})
+	}
+	attachment := *message.AttachmentById(attId)
+	if !visibleTo(userId, message, &attachment) {
+		return WriteJson(w, http.StatusNotFound, Response{
+			"err": "Attachment Not Found",
+		})
+	}
+	if name := r.URL.Query().Get("variant"); name != "" {
+		found := false
+		for _, v := range attachment.Variants {
+			if v.Name == name {
+				attachment.Path = v.Path
+				attachment.Mime = mime.TypeByExtension(filepath.Ext(v.Path))
+				attachment.Size = 0
+				found = true
+			}
+		}
+		if !found {
+			return WriteJson(w, http.StatusNotFound, Response{
+				"err": "Variant Not Found",
+			})
+		}
+	}
+	body, err := s.blobs.Get(r.Context(), attachment.Path)
+	if err != nil {
+		WriteJson(w, http.StatusBadGateway, Response{
+			"err": "Attachment Unavailable",
+		})
+		return err
+	}
+	defer body.Close()
+	serveAttachment(w, &attachment, body)
+	return nil
+}
+
+// serveAttachment streams a stored file. Only media is shown inline, and
+// of images only those we clean; every other type is offered as a download
+// so it cannot run in our origin.
+func serveAttachment(w http.ResponseWriter, attachment *t.Attachment, body io.Reader) {
+	disposition := "attachment"
+	for _, prefix := range allowedAttachmentPrefixes {
+		if strings.HasPrefix(attachment.Mime, prefix) {
+			disposition = "inline"
+		}
+	}
+	if strings.HasPrefix(attachment.Mime, "image/") && !media.Decodable(attachment.Mime) {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Type", attachment.Mime)
+	if attachment.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, body)
+}
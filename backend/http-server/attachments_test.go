@@ -0,0 +1,68 @@
+package httpserver
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	types "github.com/SourishBeast7/Glooo/types"
+)
+
+func pngBytes(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAttachmentMime(t *testing.T) {
+	heic := append([]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), make([]byte, 64)...)
+	tiff := append([]byte("II*\x00\x08\x00\x00\x00"), make([]byte, 64)...)
+	cases := []struct {
+		name, filename string
+		data           []byte
+		want           string
+	}{
+		{"decodable image", "photo.png", pngBytes(t), "image/png"},
+		{"image named otherwise", "photo.txt", pngBytes(t), "image/png"},
+		{"heic", "photo.heic", heic, "application/octet-stream"},
+		{"tiff", "scan.tiff", tiff, "application/octet-stream"},
+		{"text named like an image", "photo.jpg", []byte("hello there"), "text/plain"},
+		{"binary named like an image", "photo.jpg", []byte{0, 1, 2, 3, 4, 5}, "application/octet-stream"},
+		{"pdf", "doc.pdf", []byte("%PDF-1.7\n"), "application/pdf"},
+	}
+	for _, c := range cases {
+		got, err := attachmentMime(bytes.NewReader(c.data), c.filename)
+		if err != nil || got != c.want {
+			t.Errorf("%s: got %q, %v, want %q", c.name, got, err, c.want)
+		}
+	}
+	if _, err := attachmentMime(bytes.NewReader([]byte("MZ\x90\x00\x03\x00")), "setup.exe"); err == nil {
+		t.Error("an executable was accepted")
+	}
+}
+
+func TestServeAttachmentDisposition(t *testing.T) {
+	cases := map[string]string{
+		"image/png":                "inline",
+		"audio/mpeg":               "inline",
+		"image/heic":               "attachment",
+		"image/tiff":               "attachment",
+		"image/svg+xml":            "attachment",
+		"application/pdf":          "attachment",
+		"application/octet-stream": "attachment",
+	}
+	for mimeType, want := range cases {
+		w := httptest.NewRecorder()
+		serveAttachment(w, &types.Attachment{Name: "file", Mime: mimeType}, strings.NewReader("data"))
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Disposition"), want+";") {
+			t.Errorf("%s served as %q", mimeType, w.Header().Get("Content-Disposition"))
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package httpserver
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/SourishBeast7/Glooo/media"
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/gorilla/mux"
+)
+
+const maxAvatarSize = 10 << 20
+
+// avatarFile opens the uploaded picture in field. On failure the response
+// is already written.
+func avatarFile(w http.ResponseWriter, r *http.Request, field string) (io.ReadCloser, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarSize+(1<<20))
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		WriteJson(w, http.StatusRequestEntityTooLarge, Response{
+			"err": err.Error(),
+		})
+		return nil, err
+	}
+	file, _, err := r.FormFile(field)
+	if err != nil {
+		WriteJson(w, http.StatusNotAcceptable, Response{
+			"err": "No Picture Uploaded",
+		})
+		return nil, err
+	}
+	return file, nil
+}
+
+// avatarAdmin loads {chatid} for an admin of the group. On failure the
+// response is already written.
+func (s *Server) avatarAdmin(w http.ResponseWriter, r *http.Request) (*t.Chats, error) {
+	userId, err := currentUserId(r)
+	if err != nil {
+		WriteJson(w, http.StatusUnauthorized, Response{
+			"err": err.Error(),
+		})
+		return nil, err
+	}
+	chat, err := s.chatForUser(mux.Vars(r)["chatid"], userId)
+	if err != nil {
+		WriteJson(w, http.StatusForbidden, Response{
+			"err": "Chat Not Found",
+		})
+		return nil, err
+	}
+	if !chat.Group || !chat.IsAdmin(userId) {
+		WriteJson(w, http.StatusForbidden, Response{
+			"err": "Only Group Admins Can Change The Avatar",
+		})
+		return nil, errors.New("not a group admin")
+	}
+	return chat, nil
+}
+
+func (s *Server) handleAvatarRoutes(router *mux.Router) {
+	router.HandleFunc("/user/avatar", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
+		user, err := s.store.FindUserById(userId)
+		if err != nil {
+			WriteJson(w, http.StatusNotFound, Response{
+				"err": "User Not Found",
+			})
+			return err
+		}
+		file, err := avatarFile(w, r, "pfp")
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		avatar, err := s.storeAvatar(r.Context(), userRef(user.ID), file)
+		if errors.Is(err, media.ErrNotImage) {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Profile Picture Must Be An Image",
+			})
+		}
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		return s.writeUserAvatar(w, r, user, avatar)
+	}))).Methods(http.MethodPut)
+
+	// Removing the picture brings back the user's identicon.
+	router.HandleFunc("/user/avatar", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
+		user, err := s.store.FindUserById(userId)
+		if err != nil {
+			WriteJson(w, http.StatusNotFound, Response{
+				"err": "User Not Found",
+			})
+			return err
+		}
+		avatar, err := s.defaultAvatar(r.Context(), userRef(user.ID), userAvatarSeed(user))
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		return s.writeUserAvatar(w, r, user, avatar)
+	}))).Methods(http.MethodDelete)
+
+	router.HandleFunc("/chat/{chatid}/avatar", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		chat, err := s.avatarAdmin(w, r)
+		if err != nil {
+			return err
+		}
+		file, err := avatarFile(w, r, "avatar")
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		avatar, err := s.storeAvatar(r.Context(), chatRef(chat.ID), file)
+		if errors.Is(err, media.ErrNotImage) {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Avatar Must Be An Image",
+			})
+		}
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		return s.writeChatAvatar(w, r, chat, avatar)
+	}))).Methods(http.MethodPut)
+
+	router.HandleFunc("/chat/{chatid}/avatar", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		chat, err := s.avatarAdmin(w, r)
+		if err != nil {
+			return err
+		}
+		avatar, err := s.defaultAvatar(r.Context(), chatRef(chat.ID), chat.ID.Hex())
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		return s.writeChatAvatar(w, r, chat, avatar)
+	}))).Methods(http.MethodDelete)
+}
+
+// writeUserAvatar saves the new picture of user and lets go of the files
+// of the old one.
+func (s *Server) writeUserAvatar(w http.ResponseWriter, r *http.Request, user *t.MongoUser, avatar *t.Avatar) error {
+	owner := userRef(user.ID)
+	if err := s.store.SetUserAvatar(user.ID, avatar); err != nil {
+		s.releaseBlobs(r.Context(), owner, replacedPaths(avatar.Sizes, user.PfpSizes)...)
+		WriteJson(w, http.StatusInternalServerError, Response{
+			"success": false,
+		})
+		return err
+	}
+	s.releaseBlobs(r.Context(), owner, replacedPaths(user.PfpSizes, avatar.Sizes)...)
+	user.Pfp, user.PfpSizes = avatar.URL, avatar.Sizes
+	user.PfpGenerated, user.PfpPlaceholder = avatar.Generated, avatar.Placeholder
+	return WriteJson(w, http.StatusOK, Response{
+		"success": true,
+		"user":    s.presentUser(user),
+	})
+}
+
+// writeChatAvatar saves the new avatar of a group and tells its members.
+func (s *Server) writeChatAvatar(w http.ResponseWriter, r *http.Request, chat *t.Chats, avatar *t.Avatar) error {
+	owner := chatRef(chat.ID)
+	updated, err := s.store.SetChatAvatar(chat.ID, avatar)
+	if err != nil {
+		s.releaseBlobs(r.Context(), owner, replacedPaths(avatar.Sizes, chat.AvatarSizes)...)
+		WriteJson(w, http.StatusInternalServerError, Response{
+			"success": false,
+		})
+		return err
+	}
+	s.releaseBlobs(r.Context(), owner, replacedPaths(chat.AvatarSizes, avatar.Sizes)...)
+	presented := s.presentChat(updated)
+	s.emitToChat(updated, &t.Event{
+		Type: "chat.avatar",
+		Data: Response{
+			"chatid":            updated.ID,
+			"avatar":            presented.Avatar,
+			"avatarSizes":       presented.AvatarSizes,
+			"avatarPlaceholder": presented.AvatarPlaceholder,
+		},
+	})
+	return WriteJson(w, http.StatusOK, Response{
+		"success": true,
+		"chat":    presented,
+	})
+}
@@ -0,0 +1,138 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db"
+	"github.com/SourishBeast7/Glooo/storage"
+	t "github.com/SourishBeast7/Glooo/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// putBlob waits up to blobRetainAttempts times blobRetainWait for the
+// deletion of the same file to finish.
+const (
+	blobRetainAttempts = 10
+	blobRetainWait     = 100 * time.Millisecond
+)
+
+// Owners of stored files, as recorded in their blob references.
+func messageRef(id primitive.ObjectID) string { return "message:" + id.Hex() }
+func userRef(id primitive.ObjectID) string    { return "user:" + id.Hex() }
+func chatRef(id primitive.ObjectID) string    { return "chat:" + id.Hex() }
+
+// putBlob stores a content addressed file under key on behalf of owner.
+// A file that is already stored is only referenced again, not uploaded.
+func (s *Server) putBlob(ctx context.Context, owner, key string, r io.Reader, size int64, mimeType, hash string) (string, error) {
+	blob, existed, err := s.retainBlob(ctx, &t.Blob{
+		Key:  key,
+		Hash: hash,
+		Mime: mimeType,
+		Size: size,
+	}, owner)
+	if err != nil {
+		return "", err
+	}
+	if existed && blob.Ready {
+		return blob.URL, nil
+	}
+	// Whoever made the record may still be uploading the file, or have
+	// failed to. The key names the contents, so uploading them again is
+	// harmless.
+	url, err := s.blobs.Put(ctx, key, r, size, mimeType)
+	if err != nil {
+		s.releaseBlobs(ctx, owner, key)
+		return "", err
+	}
+	if err := s.store.MarkBlobReady(key, url); err != nil {
+		log.Printf("MarkBlobReady %s: %v", key, err)
+	}
+	return url, nil
+}
+
+// retainBlob references a blob, waiting for a deletion of the same file
+// that is under way to finish first.
+func (s *Server) retainBlob(ctx context.Context, blob *t.Blob, owner string) (*t.Blob, bool, error) {
+	for attempt := 1; ; attempt++ {
+		retained, existed, err := s.store.RetainBlob(blob, owner)
+		if !errors.Is(err, db.ErrBlobDeleting) || attempt == blobRetainAttempts {
+			return retained, existed, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-time.After(blobRetainWait):
+		}
+	}
+}
+
+// retainBlobs adds owner as a reference to files that are already stored,
+// such as the attachments of a forwarded message.
+func (s *Server) retainBlobs(owner string, paths ...string) {
+	for _, path := range paths {
+		if err := s.store.AddBlobRef(path, owner); err != nil {
+			log.Printf("AddBlobRef %s: %v", path, err)
+		}
+	}
+}
+
+// releaseBlobs drops the references of owner to paths and deletes the
+// files nothing refers to any more.
+func (s *Server) releaseBlobs(ctx context.Context, owner string, paths ...string) {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		orphaned, err := s.store.ReleaseBlob(path, owner)
+		if err != nil {
+			log.Printf("ReleaseBlob %s: %v", path, err)
+			continue
+		}
+		if !orphaned {
+			continue
+		}
+		if err := s.blobs.Delete(ctx, path); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("delete %s: %v", path, err)
+		}
+		if err := s.store.ForgetBlob(path); err != nil {
+			log.Printf("ForgetBlob %s: %v", path, err)
+		}
+	}
+}
+
+// attachmentPaths lists every stored file behind the attachments.
+func attachmentPaths(attachments ...t.Attachment) []string {
+	paths := make([]string, 0)
+	for _, a := range attachments {
+		paths = append(paths, a.Path)
+		paths = append(paths, variantPaths(a.Variants)...)
+	}
+	return paths
+}
+
+func variantPaths(variants []t.ImageVariant) []string {
+	paths := make([]string, 0, len(variants))
+	for _, v := range variants {
+		paths = append(paths, v.Path)
+	}
+	return paths
+}
+
+// replacedPaths returns the paths of old that are not reused by new.
+func replacedPaths(old, new []t.ImageVariant) []string {
+	kept := make(map[string]bool)
+	for _, v := range new {
+		kept[v.Path] = true
+	}
+	paths := make([]string, 0)
+	for _, v := range old {
+		if !kept[v.Path] {
+			paths = append(paths, v.Path)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,81 @@
+package httpserver
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	types "github.com/SourishBeast7/Glooo/types"
+)
+
+func TestPutBlobAfterFailedUpload(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	key := "attachments/shared.txt"
+
+	// The first sender's record is made, but its upload fails.
+	if _, _, err := ts.store.RetainBlob(&types.Blob{Key: key, Mime: "text/plain", Size: 4}, "message:first"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.putBlob(ctx, "message:second", key, strings.NewReader("data"), 4, "text/plain", "hash"); err != nil {
+		t.Fatal(err)
+	}
+	ts.releaseBlobs(ctx, "message:first", key)
+	if !blobExists(t, ts, key) {
+		t.Fatal("the second sender points at a file that was never stored")
+	}
+
+	// Once stored, the file is only referenced again.
+	if _, err := ts.putBlob(ctx, "message:third", key, strings.NewReader("never read"), 10, "text/plain", "hash"); err != nil {
+		t.Fatal(err)
+	}
+	ts.releaseBlobs(ctx, "message:second", key)
+	if !blobExists(t, ts, key) {
+		t.Fatal("the file went while the third sender still refers to it")
+	}
+	ts.releaseBlobs(ctx, "message:third", key)
+	if blobExists(t, ts, key) {
+		t.Fatal("the file is still stored after its last reference went")
+	}
+}
+
+func TestPutBlobWaitsForDeletion(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	key := "attachments/recycled.txt"
+	if _, err := ts.putBlob(ctx, "message:old", key, strings.NewReader("data"), 4, "text/plain", "hash"); err != nil {
+		t.Fatal(err)
+	}
+	// The last reference goes, and the file is about to be deleted.
+	orphaned, err := ts.store.ReleaseBlob(key, "message:old")
+	if err != nil || !orphaned {
+		t.Fatalf("ReleaseBlob: %v, %v", orphaned, err)
+	}
+
+	// The same file is sent again meanwhile.
+	stored := make(chan error, 1)
+	go func() {
+		_, err := ts.putBlob(ctx, "message:new", key, strings.NewReader("data"), 4, "text/plain", "hash")
+		stored <- err
+	}()
+	time.Sleep(2 * blobRetainWait)
+	select {
+	case err := <-stored:
+		t.Fatalf("stored while the file was being deleted: %v", err)
+	default:
+	}
+	if err := ts.blobs.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.store.ForgetBlob(key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-stored; err != nil {
+		t.Fatal(err)
+	}
+	if !blobExists(t, ts, key) {
+		t.Fatal("the deletion removed the file stored again")
+	}
+}
@@ -0,0 +1,136 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/SourishBeast7/Glooo/db"
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	maxForwardMessages = 10
+	maxForwardChats    = 5
+	// Messages that already went through this many forwards can only be
+	// passed on to one chat at a time.
+	frequentlyForwarded = 5
+)
+
+type forwardRequest struct {
+	Messages []string `json:"messages"`
+	Chats    []string `json:"chats"`
+}
+
+func (s *Server) handleForwardRoutes(router *mux.Router) {
+	router.HandleFunc("/messages/forward", m.VerifiedMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
+		body := new(forwardRequest)
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": err.Error(),
+			})
+		}
+		if len(body.Messages) == 0 || len(body.Chats) == 0 {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Nothing To Forward",
+			})
+		}
+		if len(body.Messages) > maxForwardMessages {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": fmt.Sprintf("At Most %d Messages Can Be Forwarded At Once", maxForwardMessages),
+			})
+		}
+		if len(body.Chats) > maxForwardChats {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": fmt.Sprintf("Messages Can Be Forwarded To At Most %d Chats", maxForwardChats),
+			})
+		}
+
+		sources := make([]*t.Message, 0, len(body.Messages))
+		readable := make(map[primitive.ObjectID]bool)
+		for _, hex := range body.Messages {
+			id, err := primitive.ObjectIDFromHex(hex)
+			if err != nil {
+				return WriteJson(w, http.StatusNotAcceptable, Response{
+					"err": err.Error(),
+				})
+			}
+			msg := s.store.FindMessagesById(id)
+			if msg == nil {
+				return WriteJson(w, http.StatusNotFound, Response{
+					"err": "Message Not Found",
+				})
+			}
+			if _, checked := readable[msg.ChatId]; !checked {
+				_, err := s.chatForUser(msg.ChatId.Hex(), userId)
+				readable[msg.ChatId] = err == nil
+			}
+			if !readable[msg.ChatId] {
+				return WriteJson(w, http.StatusNotFound, Response{
+					"err": "Message Not Found",
+				})
+			}
+			for _, a := range msg.Attachments {
+				if !a.Available() {
+					return WriteJson(w, http.StatusConflict, Response{
+						"err": "Attachments Not Cleared By The Scan Cannot Be Forwarded",
+					})
+				}
+			}
+			if msg.Forwards >= frequentlyForwarded && len(body.Chats) > 1 {
+				return WriteJson(w, http.StatusTooManyRequests, Response{
+					"err": "Frequently Forwarded Messages Can Only Be Forwarded To One Chat",
+				})
+			}
+			sources = append(sources, msg)
+		}
+
+		destinations := make([]*t.Chats, 0, len(body.Chats))
+		seen := make(map[string]bool)
+		for _, hex := range body.Chats {
+			if seen[hex] {
+				continue
+			}
+			seen[hex] = true
+			chat, err := s.chatForUser(hex, userId)
+			if err != nil {
+				WriteJson(w, http.StatusForbidden, Response{
+					"err": "Chat Not Found",
+				})
+				return err
+			}
+			destinations = append(destinations, chat)
+		}
+
+		forwarded := make([]*t.Message, 0, len(sources)*len(destinations))
+		for _, chat := range destinations {
+			for _, src := range sources {
+				fwd := db.ForwardedCopy(src, chat.ID, userId)
+				fwd.To = recipientOf(chat, userId)
+				if _, err := s.store.AddMessage(fwd); err != nil {
+					WriteJson(w, http.StatusInternalServerError, Response{
+						"success":   false,
+						"forwarded": forwarded,
+					})
+					return err
+				}
+				s.retainBlobs(messageRef(fwd.ID), attachmentPaths(fwd.Attachments...)...)
+				s.emitMessage(chat, fwd)
+				forwarded = append(forwarded, s.presentMessage(userId, fwd))
+			}
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success":   true,
+			"forwarded": forwarded,
+		})
+	}))).Methods(http.MethodPost)
+}
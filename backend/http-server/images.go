@@ -0,0 +1,99 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/SourishBeast7/Glooo/media"
+	t "github.com/SourishBeast7/Glooo/types"
+)
+
+// storedImage is an uploaded image after processing, with every rendition
+// stored under a name derived from its contents.
+type storedImage struct {
+	Original    *media.Rendition
+	Path        string
+	URL         string
+	Variants    []t.ImageVariant
+	Placeholder *t.Placeholder
+}
+
+// storeImage processes an uploaded image and stores its variants below
+// prefix on behalf of owner. The cleaned original is only kept when
+// keepOriginal is set.
+func (s *Server) storeImage(ctx context.Context, owner, prefix string, r io.Reader, variants []media.Variant, keepOriginal bool) (*storedImage, error) {
+	processed, err := media.Process(r, variants)
+	if err != nil {
+		return nil, err
+	}
+	stored := &storedImage{
+		Original: processed.Original,
+		Placeholder: &t.Placeholder{
+			BlurHash: processed.BlurHash,
+			Color:    processed.Color,
+		},
+	}
+	if keepOriginal {
+		stored.Path = prefix + processed.Original.Name
+		stored.URL, err = s.putRendition(ctx, owner, stored.Path, processed.Original)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range processed.Variants {
+		path := prefix + v.Name
+		url, err := s.putRendition(ctx, owner, path, v)
+		if err != nil {
+			s.releaseBlobs(ctx, owner, append(variantPaths(stored.Variants), stored.Path)...)
+			return nil, err
+		}
+		stored.Variants = append(stored.Variants, t.ImageVariant{
+			Name:   v.Variant,
+			Width:  v.Width,
+			Height: v.Height,
+			Path:   path,
+			URL:    url,
+		})
+	}
+	return stored, nil
+}
+
+func (s *Server) putRendition(ctx context.Context, owner, path string, r *media.Rendition) (string, error) {
+	return s.putBlob(ctx, owner, path, bytes.NewReader(r.Data), int64(len(r.Data)), r.Mime, r.Hash)
+}
+
+// storeAvatar stores a profile picture or group avatar in all its sizes.
+func (s *Server) storeAvatar(ctx context.Context, owner string, r io.Reader) (*t.Avatar, error) {
+	stored, err := s.storeImage(ctx, owner, "avatars/", r, media.AvatarVariants, false)
+	if err != nil {
+		return nil, err
+	}
+	return &t.Avatar{
+		URL:         stored.Variants[0].URL,
+		Sizes:       stored.Variants,
+		Placeholder: stored.Placeholder,
+	}, nil
+}
+
+// defaultAvatar generates and stores the identicon for seed, going through
+// the same processing as uploaded pictures.
+func (s *Server) defaultAvatar(ctx context.Context, owner, seed string) (*t.Avatar, error) {
+	identicon, err := media.Identicon(seed)
+	if err != nil {
+		return nil, err
+	}
+	avatar, err := s.storeAvatar(ctx, owner, bytes.NewReader(identicon))
+	if err != nil {
+		return nil, err
+	}
+	avatar.Generated = true
+	return avatar, nil
+}
+
+// userAvatarSeed keeps a user's identicon stable for the life of their
+// account.
+func userAvatarSeed(user *t.MongoUser) string {
+	return strings.ToLower(user.Email)
+}
@@ -0,0 +1,23 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Rotated keys are noticed this quickly, both for signing and on the JWKS
+// endpoint.
+const keyReloadInterval = time.Minute
+
+func (s *Server) handleKeyRoutes(router *mux.Router) {
+	// Other services verify our access tokens with these keys, looked up
+	// by the kid header of the token.
+	router.HandleFunc("/.well-known/jwks.json", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		return json.NewEncoder(w).Encode(s.keys.JWKS())
+	})).Methods(http.MethodGet)
+}
@@ -0,0 +1,186 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	prioritySilent = "silent"
+)
+
+// mentionPattern matches @handle when the @ starts a word, so addresses
+// like bob@example.com are left alone. Trailing dots and dashes are
+// punctuation rather than part of the handle.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_@])(@[\p{L}\p{N}_](?:[\p{L}\p{N}_.\-]*[\p{L}\p{N}_])?)`)
+
+// mentionHandle turns a display name into the form used after @, e.g.
+// "Jane Doe" becomes "janedoe".
+func mentionHandle(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), ""))
+}
+
+// parseMentions resolves the @name and @all references in text against the
+// participants of a group. A participant can be mentioned by their full name
+// without spaces, the local part of their email, or their first name when no
+// one else in the group shares it.
+func parseMentions(text string, participants []t.MongoUser, from primitive.ObjectID) ([]t.Mention, bool) {
+	handles := make(map[string]primitive.ObjectID)
+	firstNames := make(map[string][]primitive.ObjectID)
+	for _, p := range participants {
+		if p.ID == from {
+			continue
+		}
+		handles[mentionHandle(p.Name)] = p.ID
+		if local, _, ok := strings.Cut(p.Email, "@"); ok {
+			handles[strings.ToLower(local)] = p.ID
+		}
+		if fields := strings.Fields(p.Name); len(fields) > 0 {
+			first := strings.ToLower(fields[0])
+			firstNames[first] = append(firstNames[first], p.ID)
+		}
+	}
+	for first, ids := range firstNames {
+		if _, taken := handles[first]; !taken && len(ids) == 1 {
+			handles[first] = ids[0]
+		}
+	}
+
+	mentions := make([]t.Mention, 0)
+	all := false
+	seen := make(map[primitive.ObjectID]bool)
+	for _, loc := range mentionPattern.FindAllStringSubmatchIndex(text, -1) {
+		start, end := loc[2], loc[3]
+		handle := strings.ToLower(text[start+1 : end])
+		if handle == "all" {
+			all = true
+			continue
+		}
+		id, ok := handles[handle]
+		if !ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		mentions = append(mentions, t.Mention{
+			UserId: id,
+			Offset: utf8.RuneCountInString(text[:start]),
+			Length: utf8.RuneCountInString(text[start:end]),
+		})
+	}
+	return mentions, all
+}
+
+// emitMessage announces a new message to every participant of the chat.
+// Mentioned users get it with high priority even if they muted the chat;
+// otherwise muted chats are delivered silently.
+func (s *Server) emitMessage(chat *t.Chats, message *t.Message) {
+	mentioned := make(map[primitive.ObjectID]bool)
+	for _, mention := range message.Mentions {
+		mentioned[mention.UserId] = true
+	}
+	users, err := s.store.FindUsersByIds(chat.Participants)
+	if err != nil {
+		log.Printf("emitMessage: %v", err)
+		s.emitToChat(chat, &t.Event{
+			Type: "message.new",
+			Data: message,
+		})
+		return
+	}
+	for _, user := range users {
+		priority := priorityNormal
+		switch {
+		case user.ID != message.From && (mentioned[user.ID] || message.MentionAll):
+			priority = priorityHigh
+		case user.HasMuted(chat.ID):
+			priority = prioritySilent
+		}
+		s.emit([]primitive.ObjectID{user.ID}, &t.Event{
+			Type:     "message.new",
+			Priority: priority,
+			Data:     s.presentMessage(user.ID, message),
+		})
+	}
+}
+
+func (s *Server) handleMentionRoutes(router *mux.Router) {
+	router.HandleFunc("/mentions", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
+		user, err := s.store.FindUserById(userId)
+		if err != nil {
+			WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": err.Error(),
+			})
+			return err
+		}
+		before := primitive.NilObjectID
+		if b := r.URL.Query().Get("before"); b != "" {
+			if before, err = primitive.ObjectIDFromHex(b); err != nil {
+				return WriteJson(w, http.StatusNotAcceptable, Response{
+					"err": err.Error(),
+				})
+			}
+		}
+		messages, err := s.store.FindMentions(user, before)
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success":  true,
+			"mentions": s.presentMessages(userId, messages),
+		})
+	}))).Methods(http.MethodGet)
+
+	router.HandleFunc("/chat/{chatid}/mute", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
+		chat, err := s.chatForUser(mux.Vars(r)["chatid"], userId)
+		if err != nil {
+			WriteJson(w, http.StatusForbidden, Response{
+				"err": "Chat Not Found",
+			})
+			return err
+		}
+		body := struct {
+			Muted bool `json:"muted"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": err.Error(),
+			})
+		}
+		if err := s.store.SetChatMuted(userId, chat.ID, body.Muted); err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+			"muted":   body.Muted,
+		})
+	}))).Methods(http.MethodPost)
+}
@@ -0,0 +1,281 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/SourishBeast7/Glooo/db"
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// recipientOf returns the other participant of a direct chat, or the nil
+// id for groups.
+func recipientOf(chat *t.Chats, from primitive.ObjectID) primitive.ObjectID {
+	if !chat.Group {
+		for _, p := range chat.Participants {
+			if p != from {
+				return p
+			}
+		}
+	}
+	return primitive.NilObjectID
+}
+
+// newMessageRequest accepts either typed content or, as older clients send
+// it, plain text in data.
+type newMessageRequest struct {
+	Data    string            `json:"data"`
+	Content *t.MessageContent `json:"content"`
+	ReplyTo string            `json:"replyTo"`
+}
+
+func (s *Server) handleMessageRoutes(router *mux.Router) {
+	router.HandleFunc("/chat/{chatid}/messages", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
+		chat, err := s.chatForUser(mux.Vars(r)["chatid"], userId)
+		if err != nil {
+			WriteJson(w, http.StatusForbidden, Response{
+				"err": "Chat Not Found",
+			})
+			return err
+		}
+		messages, ok := s.store.FindMessagesByChatId(chat.ID.Hex())
+		return WriteJson(w, http.StatusOK, Response{
+			"success":  ok,
+			"messages": s.presentMessages(userId, messages),
+		})
+	}))).Methods(http.MethodGet)
+
+	router.HandleFunc("/chat/{chatid}/messages", m.VerifiedMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
+		chat, err := s.chatForUser(mux.Vars(r)["chatid"], userId)
+		if err != nil {
+			WriteJson(w, http.StatusForbidden, Response{
+				"err": "Chat Not Found",
+			})
+			return err
+		}
+		body := new(newMessageRequest)
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": err.Error(),
+			})
+		}
+		if body.Content == nil {
+			body.Content = t.TextMessageContent(body.Data)
+		}
+		body.Content.Render = nil
+		if body.Content.Media != nil && body.Content.Media.AttachmentId != nil {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Attachments Must Be Uploaded To The Chat",
+			})
+		}
+		if err := body.Content.Validate(); err != nil {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": err.Error(),
+			})
+		}
+		message := new(t.Message)
+		message.Content = body.Content
+		message.Data = body.Content.Summary()
+		message.From = userId
+		message.ChatId = chat.ID
+		message.To = recipientOf(chat, userId)
+		if chat.Group {
+			participants, err := s.store.FindUsersByIds(chat.Participants)
+			if err != nil {
+				WriteJson(w, http.StatusInternalServerError, Response{
+					"success": false,
+				})
+				return err
+			}
+			message.Mentions, message.MentionAll = parseMentions(message.Data, participants, userId)
+		}
+		if body.ReplyTo != "" {
+			parentId, err := primitive.ObjectIDFromHex(body.ReplyTo)
+			if err != nil {
+				return WriteJson(w, http.StatusNotAcceptable, Response{
+					"err": err.Error(),
+				})
+			}
+			parent := s.store.FindMessagesById(parentId)
+			if parent == nil || parent.ChatId != chat.ID {
+				return WriteJson(w, http.StatusNotAcceptable, Response{
+					"err": "Reply Target Not Found In Chat",
+				})
+			}
+			// Replies to replies stay in the thread of the original root.
+			threadId := parent.ID
+			if parent.ThreadId != nil {
+				threadId = *parent.ThreadId
+			}
+			message.ReplyTo = &parent.ID
+			message.ThreadId = &threadId
+			message.Quote = db.QuoteOf(parent)
+		}
+		if _, err := s.store.AddMessage(message); err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		s.emitMessage(chat, message)
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+			"message": s.presentMessage(userId, message),
+		})
+	}))).Methods(http.MethodPost)
+
+	// Deleting a message also lets go of its attachments; files no other
+	// message or user refers to are removed from storage.
+	router.HandleFunc("/chat/{chatid}/messages/{msgid}", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
+		vars := mux.Vars(r)
+		chat, err := s.chatForUser(vars["chatid"], userId)
+		if err != nil {
+			WriteJson(w, http.StatusForbidden, Response{
+				"err": "Chat Not Found",
+			})
+			return err
+		}
+		msgId, err := primitive.ObjectIDFromHex(vars["msgid"])
+		if err != nil {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": err.Error(),
+			})
+		}
+		message := s.store.FindMessagesById(msgId)
+		if message == nil || message.ChatId != chat.ID {
+			return WriteJson(w, http.StatusNotFound, Response{
+				"err": "Message Not Found",
+			})
+		}
+		if message.From != userId {
+			return WriteJson(w, http.StatusForbidden, Response{
+				"err": "Only The Sender Can Delete A Message",
+			})
+		}
+		if err := s.store.DeleteMessage(message); err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		s.releaseBlobs(r.Context(), messageRef(message.ID), attachmentPaths(message.Attachments...)...)
+		s.emitToChat(chat, &t.Event{
+			Type: "message.delete",
+			Data: Response{
+				"chatid":    chat.ID,
+				"messageId": message.ID,
+			},
+		})
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodDelete)
+
+	router.HandleFunc("/chat/{chatid}/thread/{msgid}", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, rootId, err := s.threadRequest(w, r)
+		if err != nil {
+			return err
+		}
+		thread, err := s.store.FindThread(rootId, userId)
+		if err != nil {
+			WriteJson(w, http.StatusNotFound, Response{
+				"err": "Thread Not Found",
+			})
+			return err
+		}
+		thread.Root = s.presentMessage(userId, thread.Root)
+		thread.Replies = s.presentMessages(userId, thread.Replies)
+		return WriteJson(w, http.StatusOK, Response{
+			"thread": thread,
+		})
+	}))).Methods(http.MethodGet)
+
+	router.HandleFunc("/chat/{chatid}/thread/{msgid}/read", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, rootId, err := s.threadRequest(w, r)
+		if err != nil {
+			return err
+		}
+		if err := s.store.MarkThreadRead(rootId, userId); err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPost)
+
+	s.handleReactionRoutes(router)
+	s.handleForwardRoutes(router)
+	s.handlePinRoutes(router)
+	s.handleMentionRoutes(router)
+	s.handleAttachmentRoutes(router)
+	s.handleUploadRoutes(router)
+}
+
+// threadRequest validates a request addressing the thread under {msgid} in
+// the group chat {chatid}. On failure the error response is already written.
+func (s *Server) threadRequest(w http.ResponseWriter, r *http.Request) (primitive.ObjectID, primitive.ObjectID, error) {
+	n := primitive.NilObjectID
+	vars := mux.Vars(r)
+	userId, err := currentUserId(r)
+	if err != nil {
+		WriteJson(w, http.StatusUnauthorized, Response{
+			"err": err.Error(),
+		})
+		return n, n, err
+	}
+	chat, err := s.chatForUser(vars["chatid"], userId)
+	if err != nil {
+		WriteJson(w, http.StatusForbidden, Response{
+			"err": "Chat Not Found",
+		})
+		return n, n, err
+	}
+	if !chat.Group {
+		err := fmt.Errorf("chat %s is not a group", chat.ID.Hex())
+		WriteJson(w, http.StatusNotAcceptable, Response{
+			"err": "Threads Are Only Available In Groups",
+		})
+		return n, n, err
+	}
+	rootId, err := primitive.ObjectIDFromHex(vars["msgid"])
+	if err != nil {
+		WriteJson(w, http.StatusNotAcceptable, Response{
+			"err": err.Error(),
+		})
+		return n, n, err
+	}
+	root := s.store.FindMessagesById(rootId)
+	if root == nil || root.ChatId != chat.ID || root.ThreadId != nil {
+		err := fmt.Errorf("message %s is not a thread root in chat %s", vars["msgid"], chat.ID.Hex())
+		WriteJson(w, http.StatusNotFound, Response{
+			"err": "Thread Not Found",
+		})
+		return n, n, err
+	}
+	return userId, rootId, nil
+}
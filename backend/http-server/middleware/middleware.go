@@ -1,37 +1,138 @@
 package middleware
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"net/http"
-	"os"
 	"strings"
 
+	"github.com/SourishBeast7/Glooo/keys"
 	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// Claims are carried by our access tokens. The subject is the hex id of
+// the user and sid the login the token was issued for.
+type Claims struct {
+	Email      string `json:"email"`
+	Name       string `json:"name"`
+	CreatedAt  string `json:"createdAt"`
+	SessionId  string `json:"sid"`
+	Unverified bool   `json:"unverified,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Principal is the authenticated user behind a request.
+type Principal struct {
+	UserId    primitive.ObjectID
+	SessionId primitive.ObjectID
+	Email     string
+	TokenId   string
+	// Unverified is set until the user confirms their email address.
+	Unverified bool
+}
+
+type principalKey struct{}
+
+// RevocationList tells whether a session has been logged out.
+type RevocationList interface {
+	IsRevoked(sessionId primitive.ObjectID) bool
+}
+
+// ActivityRecorder is told about every authenticated request.
+type ActivityRecorder interface {
+	Active(principal *Principal, r *http.Request)
+}
+
+var (
+	keyset      *keys.Keyset
+	revocations RevocationList
+	activity    ActivityRecorder
+)
+
+// UseKeyset sets the keys access tokens are verified with.
+func UseKeyset(k *keys.Keyset) {
+	keyset = k
+}
+
+// UseRevocationList makes AuthMiddleWare refuse tokens of revoked sessions.
+func UseRevocationList(list RevocationList) {
+	revocations = list
+}
+
+// UseActivityRecorder reports authenticated requests to recorder.
+func UseActivityRecorder(recorder ActivityRecorder) {
+	activity = recorder
+}
+
+// PrincipalFrom returns the user AuthMiddleWare authenticated.
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// bearerToken reads the token from the token cookie, or from the
+// Authorization header for clients that cannot keep cookies.
+func bearerToken(r *http.Request) (string, bool) {
+	value := r.Header.Get("Authorization")
+	if cookie, err := r.Cookie("token"); err == nil {
+		value = cookie.Value
+	}
+	return strings.CutPrefix(value, "Bearer ")
+}
+
 func AuthMiddleWare(f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("token")
-		if err != nil {
-			log.Println(err.Error())
+		tokenStr, ok := bearerToken(r)
+		if !ok {
 			http.Error(w, "Invalid Token String", http.StatusUnauthorized)
 			return
 		}
-
-		tokenStr := strings.Split(cookie.Value, " ")[1]
-		token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (any, error) {
-			if m, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				log.Println(ok)
-				return nil, fmt.Errorf("unrecognized signing method : %v", m)
-			}
-			return []byte(os.Getenv("JWT_SECRET")), nil
-		})
+		claims := new(Claims)
+		token, err := jwt.ParseWithClaims(tokenStr, claims, keyset.Keyfunc,
+			jwt.WithValidMethods(keyset.Methods()), jwt.WithExpirationRequired(), jwt.WithIssuedAt())
 		if err != nil || !token.Valid {
-			log.Printf("%+v", err.Error())
+			log.Printf("%+v", err)
 			http.Error(w, "Unauthorized - Invalid Token", http.StatusUnauthorized)
 			return
 		}
-		f(w, r)
+		userId, err := primitive.ObjectIDFromHex(claims.Subject)
+		if err != nil {
+			http.Error(w, "Unauthorized - Invalid Token", http.StatusUnauthorized)
+			return
+		}
+		sessionId, err := primitive.ObjectIDFromHex(claims.SessionId)
+		if err != nil {
+			http.Error(w, "Unauthorized - Invalid Token", http.StatusUnauthorized)
+			return
+		}
+		if revocations != nil && revocations.IsRevoked(sessionId) {
+			http.Error(w, "Unauthorized - Session Ended", http.StatusUnauthorized)
+			return
+		}
+		principal := &Principal{
+			UserId:     userId,
+			SessionId:  sessionId,
+			Email:      claims.Email,
+			TokenId:    claims.ID,
+			Unverified: claims.Unverified,
+		}
+		if activity != nil {
+			activity.Active(principal, r)
+		}
+		ctx := context.WithValue(r.Context(), principalKey{}, principal)
+		f(w, r.WithContext(ctx))
 	}
 }
+
+// VerifiedMiddleWare is AuthMiddleWare for routes closed to users who have
+// not confirmed their email address yet.
+func VerifiedMiddleWare(f http.HandlerFunc) http.HandlerFunc {
+	return AuthMiddleWare(func(w http.ResponseWriter, r *http.Request) {
+		if principal, _ := PrincipalFrom(r.Context()); principal.Unverified {
+			http.Error(w, "Forbidden - Email Not Verified", http.StatusForbidden)
+			return
+		}
+		f(w, r)
+	})
+}
@@ -0,0 +1,356 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db"
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcStateCookie = "oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+	oidcTimeout     = 15 * time.Second
+)
+
+const defaultPublicURL = "http://localhost:3000"
+
+// publicURL is where browsers reach this server, for the redirect URIs
+// registered with login providers.
+func publicURL() string {
+	if v := os.Getenv("PUBLIC_URL"); v != "" {
+		return strings.TrimSuffix(v, "/")
+	}
+	return defaultPublicURL
+}
+
+// oidcProvider is a configured OpenID Connect issuer. Its discovery
+// document is fetched on first use, so a provider that is down does not
+// keep the server from starting.
+type oidcProvider struct {
+	name        string
+	displayName string
+	issuer      string
+	config      oauth2.Config
+
+	mutex    sync.Mutex
+	verifier *oidc.IDTokenVerifier
+}
+
+// loadOIDCProviders reads the providers named in OIDC_PROVIDERS, e.g.
+// "google,okta". Each is set up with OIDC_<NAME>_ISSUER,
+// OIDC_<NAME>_CLIENT_ID, OIDC_<NAME>_CLIENT_SECRET and optionally
+// OIDC_<NAME>_DISPLAY_NAME and extra OIDC_<NAME>_SCOPES.
+func loadOIDCProviders() map[string]*oidcProvider {
+	providers := make(map[string]*oidcProvider)
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		env := func(key string) string {
+			return os.Getenv("OIDC_" + strings.ToUpper(name) + "_" + key)
+		}
+		issuer, clientId := env("ISSUER"), env("CLIENT_ID")
+		if issuer == "" || clientId == "" {
+			log.Printf("⚠️ OIDC provider %s needs an issuer and a client id, skipping it", name)
+			continue
+		}
+		displayName := env("DISPLAY_NAME")
+		if displayName == "" {
+			displayName = name
+		}
+		scopes := []string{oidc.ScopeOpenID, "email", "profile"}
+		scopes = append(scopes, strings.Fields(env("SCOPES"))...)
+		providers[name] = &oidcProvider{
+			name:        name,
+			displayName: displayName,
+			issuer:      issuer,
+			config: oauth2.Config{
+				ClientID:     clientId,
+				ClientSecret: env("CLIENT_SECRET"),
+				RedirectURL:  publicURL() + "/auth/oidc/" + name + "/callback",
+				Scopes:       scopes,
+			},
+		}
+	}
+	return providers
+}
+
+// discover fetches the issuer's endpoints and keys once.
+func (p *oidcProvider) discover(ctx context.Context) (*oidc.IDTokenVerifier, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.verifier != nil {
+		return p.verifier, nil
+	}
+	provider, err := oidc.NewProvider(ctx, p.issuer)
+	if err != nil {
+		return nil, err
+	}
+	p.config.Endpoint = provider.Endpoint()
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.config.ClientID})
+	return p.verifier, nil
+}
+
+// oidcClaims are the parts of an ID token we use.
+type oidcClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// oidcName is the name of an account made through a provider: the one it
+// shares, or else the start of the address.
+func oidcName(claims *oidcClaims, email string) string {
+	if claims.Name != "" {
+		return claims.Name
+	}
+	name, _, _ := strings.Cut(email, "@")
+	return name
+}
+
+// oidcFailed sends the browser back to the login page with reason.
+func oidcFailed(w http.ResponseWriter, r *http.Request, reason string, err error) error {
+	http.Redirect(w, r, appURL()+"/login?error="+url.QueryEscape(reason), http.StatusSeeOther)
+	if err == nil {
+		err = errors.New(reason)
+	}
+	return fmt.Errorf("oidc login: %w", err)
+}
+
+// oidcUser finds the user an identity logs in as. Unknown identities are
+// linked to the account with the same address, or get a new account, but
+// only when the provider vouches for the address. An unverified account
+// is claimed on linking: whatever it was signed up with stops working.
+func (s *Server) oidcUser(ctx context.Context, provider, subject string, claims *oidcClaims) (*t.MongoUser, string, error) {
+	user, err := s.store.FindUserByIdentity(provider, subject)
+	if err == nil {
+		return user, "", nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, "Login Failed", err
+	}
+	email := db.NormalizeEmail(claims.Email)
+	if email == "" {
+		return nil, "Provider Did Not Share An Email", nil
+	}
+	// Accounts are keyed by address, so one the provider has not checked
+	// could belong to someone else.
+	if !claims.EmailVerified {
+		return nil, "Email Not Verified By Provider", nil
+	}
+	identity := &t.Identity{
+		Provider: provider,
+		Subject:  subject,
+		Email:    email,
+		LinkedAt: time.Now(),
+	}
+
+	user, err = s.store.FindUserByEmail(email)
+	switch {
+	case err == nil:
+		if user.Unverified {
+			owner := userRef(user.ID)
+			name := oidcName(claims, email)
+			avatar, err := s.defaultAvatar(ctx, owner, userAvatarSeed(user))
+			if err != nil {
+				return nil, "Login Failed", err
+			}
+			claimed, err := s.store.ClaimUnverifiedUser(user.ID, name, avatar)
+			if err != nil || !claimed {
+				s.releaseBlobs(ctx, owner, replacedPaths(avatar.Sizes, user.PfpSizes)...)
+			}
+			if err != nil {
+				return nil, "Login Failed", err
+			}
+			if claimed {
+				s.releaseBlobs(ctx, owner, replacedPaths(user.PfpSizes, avatar.Sizes)...)
+				if err := s.revokeAllSessions(user.ID); err != nil {
+					return nil, "Login Failed", err
+				}
+				user.Password, user.TwoFactor, user.Passkeys, user.Identities = "", nil, nil, nil
+				user.Name, user.Pfp, user.PfpSizes = name, avatar.URL, avatar.Sizes
+				user.PfpGenerated, user.PfpPlaceholder = avatar.Generated, avatar.Placeholder
+			}
+			user.Unverified = false
+		}
+		if err := s.store.AddIdentity(user.ID, identity); err != nil {
+			return nil, "Login Failed", err
+		}
+		return user, "", nil
+	case !errors.Is(err, mongo.ErrNoDocuments):
+		return nil, "Login Failed", err
+	}
+
+	user = &t.MongoUser{
+		ID:         primitive.NewObjectID(),
+		Email:      email,
+		Name:       oidcName(claims, email),
+		Identities: []t.Identity{*identity},
+	}
+	avatar, err := s.defaultAvatar(ctx, userRef(user.ID), userAvatarSeed(user))
+	if err != nil {
+		return nil, "Login Failed", err
+	}
+	user.Pfp, user.PfpSizes = avatar.URL, avatar.Sizes
+	user.PfpGenerated, user.PfpPlaceholder = avatar.Generated, avatar.Placeholder
+	if _, err := s.store.AddUser(user); err != nil {
+		s.releaseBlobs(ctx, userRef(user.ID), variantPaths(user.PfpSizes)...)
+		return nil, "Login Failed", err
+	}
+	return user, "", nil
+}
+
+func (s *Server) handleOIDCRoutes(router *mux.Router) {
+	// Lists the providers to show login buttons for.
+	router.HandleFunc("/oidc/providers", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		providers := make([]Response, 0, len(s.oidc))
+		for _, p := range s.oidc {
+			providers = append(providers, Response{
+				"name":        p.name,
+				"displayName": p.displayName,
+				"login":       "/auth/oidc/" + p.name + "/login",
+			})
+		}
+		sort.Slice(providers, func(i, j int) bool {
+			return providers[i]["name"].(string) < providers[j]["name"].(string)
+		})
+		return WriteJson(w, http.StatusOK, Response{
+			"providers": providers,
+		})
+	})).Methods(http.MethodGet)
+
+	// The browser is sent to the provider with a PKCE challenge, a nonce
+	// for the ID token and a state that is also kept in a cookie, so that
+	// only the browser that started a login can finish it.
+	router.HandleFunc("/oidc/{provider}/login", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, ok := s.oidc[mux.Vars(r)["provider"]]
+		if !ok {
+			return WriteJson(w, http.StatusNotFound, Response{
+				"err": "Unknown Provider",
+			})
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), oidcTimeout)
+		defer cancel()
+		if _, err := p.discover(ctx); err != nil {
+			return oidcFailed(w, r, "Provider Unavailable", err)
+		}
+		random := make([]byte, 64)
+		if _, err := rand.Read(random); err != nil {
+			return err
+		}
+		state := base64.RawURLEncoding.EncodeToString(random[:32])
+		nonce := base64.RawURLEncoding.EncodeToString(random[32:])
+		verifier := oauth2.GenerateVerifier()
+		if err := s.store.AddOIDCState(&t.OIDCState{
+			Hash:      hashToken(state),
+			Provider:  p.name,
+			Nonce:     nonce,
+			Verifier:  verifier,
+			Device:    r.URL.Query().Get("device"),
+			ExpiresAt: time.Now().Add(oidcStateTTL),
+		}); err != nil {
+			return oidcFailed(w, r, "Login Failed", err)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    state,
+			MaxAge:   int(oidcStateTTL.Seconds()),
+			HttpOnly: true,
+			Path:     "/auth/oidc",
+			SameSite: http.SameSiteLaxMode,
+			Secure:   false, // Set to true in production with HTTPS
+		})
+		target := p.config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+		http.Redirect(w, r, target, http.StatusFound)
+		return nil
+	})).Methods(http.MethodGet)
+
+	router.HandleFunc("/oidc/{provider}/callback", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p, ok := s.oidc[mux.Vars(r)["provider"]]
+		if !ok {
+			return WriteJson(w, http.StatusNotFound, Response{
+				"err": "Unknown Provider",
+			})
+		}
+		query := r.URL.Query()
+		if reason := query.Get("error"); reason != "" {
+			return oidcFailed(w, r, "Login Cancelled", errors.New(reason))
+		}
+		state := query.Get("state")
+		cookie, err := r.Cookie(oidcStateCookie)
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/auth/oidc", MaxAge: -1})
+		if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+			return oidcFailed(w, r, "Login Expired, Try Again", err)
+		}
+		stored, err := s.store.ConsumeOIDCState(hashToken(state))
+		if err != nil || stored.Provider != p.name {
+			return oidcFailed(w, r, "Login Expired, Try Again", err)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), oidcTimeout)
+		defer cancel()
+		verifier, err := p.discover(ctx)
+		if err != nil {
+			return oidcFailed(w, r, "Provider Unavailable", err)
+		}
+		token, err := p.config.Exchange(ctx, query.Get("code"), oauth2.VerifierOption(stored.Verifier))
+		if err != nil {
+			return oidcFailed(w, r, "Login Failed", err)
+		}
+		rawIdToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			return oidcFailed(w, r, "Login Failed", errors.New("no id_token in token response"))
+		}
+		idToken, err := verifier.Verify(ctx, rawIdToken)
+		if err != nil {
+			return oidcFailed(w, r, "Login Failed", err)
+		}
+		if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(stored.Nonce)) != 1 {
+			return oidcFailed(w, r, "Login Failed", errors.New("id_token nonce mismatch"))
+		}
+		claims := new(oidcClaims)
+		if err := idToken.Claims(claims); err != nil {
+			return oidcFailed(w, r, "Login Failed", err)
+		}
+
+		user, reason, err := s.oidcUser(ctx, p.name, idToken.Subject, claims)
+		if user == nil {
+			return oidcFailed(w, r, reason, err)
+		}
+		// The provider stands in for the password, not for the second
+		// factor.
+		if user.TwoFactorEnabled() {
+			challenge, err := s.newChallenge(user, stored.Device)
+			if err != nil {
+				return oidcFailed(w, r, "Login Failed", err)
+			}
+			http.Redirect(w, r, appURL()+"/login?challenge="+url.QueryEscape(challenge), http.StatusSeeOther)
+			return nil
+		}
+		if err := s.startSession(w, r, user, stored.Device); err != nil {
+			return oidcFailed(w, r, "Login Failed", err)
+		}
+		http.Redirect(w, r, appURL()+"/app/chat", http.StatusSeeOther)
+		return nil
+	})).Methods(http.MethodGet)
+}
@@ -0,0 +1,407 @@
+package httpserver
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// mockIssuer is an OpenID provider serving discovery, its signing key and
+// a token endpoint that checks PKCE. Codes are handed out with authorize
+// instead of through a login page.
+type mockIssuer struct {
+	URL string
+	key *rsa.PrivateKey
+
+	mutex  sync.Mutex
+	grants map[string]*mockGrant
+}
+
+// mockGrant is what a code is exchanged for.
+type mockGrant struct {
+	challenge string
+	claims    map[string]any
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &mockIssuer{key: key, grants: make(map[string]*mockGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                issuer.URL,
+			"authorization_endpoint":                issuer.URL + "/authorize",
+			"token_endpoint":                        issuer.URL + "/token",
+			"jwks_uri":                              issuer.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", issuer.token)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	issuer.URL = srv.URL
+	return issuer
+}
+
+func (i *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	i.mutex.Lock()
+	grant, ok := i.grants[r.FormValue("code")]
+	delete(i.grants, r.FormValue("code"))
+	i.mutex.Unlock()
+	if !ok || r.FormValue("grant_type") != "authorization_code" ||
+		oauth2.S256ChallengeFromVerifier(r.FormValue("code_verifier")) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	idToken, err := i.sign(grant.claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// sign makes an RS256 JWT of claims.
+func (i *mockIssuer) sign(claims map[string]any) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// authorize plays the login page: it approves the request the browser was
+// sent to by login and returns the state and a code for an ID token with
+// the given claims on top of the usual ones.
+func (i *mockIssuer) authorize(t *testing.T, login *url.URL, claims map[string]any) (state, code string) {
+	t.Helper()
+	query := login.Query()
+	all := map[string]any{
+		"iss":   i.URL,
+		"aud":   query.Get("client_id"),
+		"sub":   "subject-1",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	code = base64.RawURLEncoding.EncodeToString(random)
+	i.mutex.Lock()
+	i.grants[code] = &mockGrant{challenge: query.Get("code_challenge"), claims: all}
+	i.mutex.Unlock()
+	return query.Get("state"), code
+}
+
+// useIssuer sets up issuer as the provider "mock".
+func (ts *testServer) useIssuer(issuer *mockIssuer) {
+	ts.oidc["mock"] = &oidcProvider{
+		name:        "mock",
+		displayName: "Mock",
+		issuer:      issuer.URL,
+		config: oauth2.Config{
+			ClientID:     "glooo",
+			ClientSecret: "secret",
+			RedirectURL:  ts.URL + "/auth/oidc/mock/callback",
+			Scopes:       []string{"openid", "email", "profile"},
+		},
+	}
+}
+
+// startOIDC begins a login with c and returns where the browser is sent.
+func (ts *testServer) startOIDC(t *testing.T, c *http.Client) *url.URL {
+	t.Helper()
+	res, _ := ts.do(t, c, http.MethodGet, "/auth/oidc/mock/login", nil)
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("login: %d", res.StatusCode)
+	}
+	target, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+// finishOIDC comes back from the provider and returns where the browser
+// is sent next.
+func (ts *testServer) finishOIDC(t *testing.T, c *http.Client, state, code string) *url.URL {
+	t.Helper()
+	query := url.Values{"state": {state}, "code": {code}}
+	res, _ := ts.do(t, c, http.MethodGet, "/auth/oidc/mock/callback?"+query.Encode(), nil)
+	if res.StatusCode != http.StatusSeeOther {
+		t.Fatalf("callback: %d", res.StatusCode)
+	}
+	target, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+// oidcLogin logs in through issuer with the given claims and returns the
+// client and where it ended up.
+func (ts *testServer) oidcLogin(t *testing.T, issuer *mockIssuer, claims map[string]any) (*http.Client, *url.URL) {
+	t.Helper()
+	c := ts.client(t)
+	state, code := issuer.authorize(t, ts.startOIDC(t, c), claims)
+	return c, ts.finishOIDC(t, c, state, code)
+}
+
+func wantLoginError(t *testing.T, target *url.URL, reason string) {
+	t.Helper()
+	if target.Path != "/login" || target.Query().Get("error") != reason {
+		t.Fatalf("sent to %s, want the login page with %q", target, reason)
+	}
+}
+
+func wantLoggedIn(t *testing.T, ts *testServer, c *http.Client, target *url.URL) {
+	t.Helper()
+	if target.Path != "/app/chat" {
+		t.Fatalf("sent to %s, want the app", target)
+	}
+	if ts.cookie(t, c, "/", "token") == "" {
+		t.Fatal("no access token after logging in")
+	}
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	ts := newTestServer(t)
+	issuer := newMockIssuer(t)
+	ts.useIssuer(issuer)
+	claims := map[string]any{"email": "alice@example.com", "email_verified": true}
+
+	c := ts.client(t)
+	state, code := issuer.authorize(t, ts.startOIDC(t, c), claims)
+	// Another browser cannot finish the login, nor can one with a made up
+	// state.
+	wantLoginError(t, ts.finishOIDC(t, ts.client(t), state, code), "Login Expired, Try Again")
+	wantLoginError(t, ts.finishOIDC(t, c, state+"x", code), "Login Expired, Try Again")
+	if ts.cookie(t, c, "/", "token") != "" {
+		t.Fatal("logged in with the wrong state")
+	}
+	if _, err := ts.store.FindUserByEmail("alice@example.com"); err == nil {
+		t.Fatal("an account was made")
+	}
+}
+
+func TestOIDCNonceMismatch(t *testing.T) {
+	ts := newTestServer(t)
+	issuer := newMockIssuer(t)
+	ts.useIssuer(issuer)
+	c, target := ts.oidcLogin(t, issuer, map[string]any{
+		"email":          "bob@example.com",
+		"email_verified": true,
+		"nonce":          "replayed",
+	})
+	wantLoginError(t, target, "Login Failed")
+	if ts.cookie(t, c, "/", "token") != "" {
+		t.Fatal("logged in with the wrong nonce")
+	}
+}
+
+func TestOIDCWrongVerifier(t *testing.T) {
+	ts := newTestServer(t)
+	issuer := newMockIssuer(t)
+	ts.useIssuer(issuer)
+	claims := map[string]any{"email": "carol@example.com", "email_verified": true}
+
+	// A code made for another login, e.g. an attacker's, is refused by
+	// the provider since this login's verifier does not match it.
+	victim := ts.client(t)
+	state, _ := issuer.authorize(t, ts.startOIDC(t, victim), claims)
+	_, code := issuer.authorize(t, ts.startOIDC(t, ts.client(t)), claims)
+	wantLoginError(t, ts.finishOIDC(t, victim, state, code), "Login Failed")
+	if ts.cookie(t, victim, "/", "token") != "" {
+		t.Fatal("logged in with a code for another verifier")
+	}
+}
+
+func TestOIDCLinksVerifiedEmail(t *testing.T) {
+	ts := newTestServer(t)
+	requireMongoDB(t, "$elemMatch on several fields")
+	issuer := newMockIssuer(t)
+	ts.useIssuer(issuer)
+	user := ts.addUser(t, "dave@example.com", "hunter22")
+
+	c, target := ts.oidcLogin(t, issuer, map[string]any{"email": "dave@example.com", "email_verified": true})
+	wantLoggedIn(t, ts, c, target)
+	res, body := ts.do(t, c, http.MethodGet, "/api/user/me", nil)
+	if me, _ := body["user"].(map[string]any); res.StatusCode != http.StatusOK || me["email"] != "dave@example.com" {
+		t.Fatalf("user/me after an OIDC login: %d %v", res.StatusCode, body)
+	}
+	linked, err := ts.store.FindUserByIdentity("mock", "subject-1")
+	if err != nil || linked.ID != user.ID {
+		t.Fatalf("identity not linked to the account (%v)", err)
+	}
+	// The password still works for a verified account.
+	ts.login(t, "dave@example.com", "hunter22")
+
+	// Later logins find the account by its identity, whatever the email.
+	c, target = ts.oidcLogin(t, issuer, map[string]any{"email": "dave@elsewhere.example", "email_verified": false})
+	wantLoggedIn(t, ts, c, target)
+}
+
+func TestOIDCLinksEmailInAnyCase(t *testing.T) {
+	ts := newTestServer(t)
+	requireMongoDB(t, "$elemMatch on several fields")
+	issuer := newMockIssuer(t)
+	ts.useIssuer(issuer)
+	user := ts.addUser(t, "alice@example.com", "hunter22")
+
+	c, target := ts.oidcLogin(t, issuer, map[string]any{"email": "Alice@Example.com", "email_verified": true})
+	wantLoggedIn(t, ts, c, target)
+	linked, err := ts.store.FindUserByIdentity("mock", "subject-1")
+	if err != nil || linked.ID != user.ID {
+		t.Fatalf("identity not linked to the existing account (%v)", err)
+	}
+}
+
+func TestOIDCClaimsUnverifiedAccount(t *testing.T) {
+	ts := newTestServer(t)
+	requireMongoDB(t, "$elemMatch on several fields")
+	issuer := newMockIssuer(t)
+	ts.useIssuer(issuer)
+	// Someone signed up with the address without owning it.
+	squatter := ts.addUser(t, "erin@example.com", "squatter password")
+	for field, value := range map[string]any{
+		"unverified": true,
+		"name":       "Erin (official)",
+		"pfp":        "https://squatter.example/erin.png",
+	} {
+		if err := ts.store.UpdateUserDetails(squatter.ID, field, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	enableTOTP(t, ts, squatter, "squatter-recovery")
+	squatterSession := ts.client(t)
+	res, _ := ts.do(t, squatterSession, http.MethodPost, "/auth/login/2fa", Response{
+		"challenge":    challengeFor(t, ts, "erin@example.com", "squatter password"),
+		"recoveryCode": "squatter-recovery",
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("squatter login: %d", res.StatusCode)
+	}
+
+	c, target := ts.oidcLogin(t, issuer, map[string]any{"email": "erin@example.com", "email_verified": true, "name": "Erin"})
+	wantLoggedIn(t, ts, c, target)
+	user, err := ts.store.FindUserById(squatter.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Unverified || user.Password != "" || user.TwoFactorEnabled() {
+		t.Fatalf("claimed account kept its sign up: unverified %v, password %v, 2FA %v",
+			user.Unverified, user.Password != "", user.TwoFactorEnabled())
+	}
+	if user.Name != "Erin" || !user.PfpGenerated || user.Pfp == "https://squatter.example/erin.png" {
+		t.Fatalf("claimed account kept the squatter's profile: name %q, picture %q", user.Name, user.Pfp)
+	}
+	res, _ = ts.do(t, squatterSession, http.MethodGet, "/api/user/me", nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("squatter still logged in: %d", res.StatusCode)
+	}
+	squatterLogin := ts.client(t)
+	_, body := ts.do(t, squatterLogin, http.MethodPost, "/auth/login", Response{
+		"email":    "erin@example.com",
+		"password": "squatter password",
+	})
+	if body["success"] == true || ts.cookie(t, squatterLogin, "/", "token") != "" {
+		t.Fatal("squatter password still works")
+	}
+}
+
+func TestOIDCRefusesUnverifiedEmail(t *testing.T) {
+	ts := newTestServer(t)
+	requireMongoDB(t, "$elemMatch on several fields")
+	issuer := newMockIssuer(t)
+	ts.useIssuer(issuer)
+	user := ts.addUser(t, "frank@example.com", "hunter22")
+
+	c, target := ts.oidcLogin(t, issuer, map[string]any{"email": "frank@example.com", "email_verified": false})
+	wantLoginError(t, target, "Email Not Verified By Provider")
+	if ts.cookie(t, c, "/", "token") != "" {
+		t.Fatal("logged in with an unverified email")
+	}
+	if user, err := ts.store.FindUserById(user.ID); err != nil || len(user.Identities) != 0 {
+		t.Fatalf("identity linked on an unverified email (%v)", err)
+	}
+
+	_, target = ts.oidcLogin(t, issuer, map[string]any{"email": "grace@example.com", "email_verified": false})
+	wantLoginError(t, target, "Email Not Verified By Provider")
+	if _, err := ts.store.FindUserByEmail("grace@example.com"); err == nil {
+		t.Fatal("an account was made for an unverified email")
+	}
+}
+
+func TestOIDCTwoFactorChallenge(t *testing.T) {
+	ts := newTestServer(t)
+	requireMongoDB(t, "$elemMatch on several fields")
+	issuer := newMockIssuer(t)
+	ts.useIssuer(issuer)
+	user := ts.addUser(t, "heidi@example.com", "hunter22")
+	secret := enableTOTP(t, ts, user, "recovery-one")
+
+	c, target := ts.oidcLogin(t, issuer, map[string]any{"email": "heidi@example.com", "email_verified": true})
+	challenge := target.Query().Get("challenge")
+	if target.Path != "/login" || challenge == "" {
+		t.Fatalf("sent to %s, want a 2FA challenge", target)
+	}
+	if ts.cookie(t, c, "/", "token") != "" {
+		t.Fatal("logged in without the second factor")
+	}
+	res, body := ts.do(t, c, http.MethodPost, "/auth/login/2fa", Response{
+		"challenge": challenge,
+		"code":      currentCode(t, secret),
+	})
+	if res.StatusCode != http.StatusOK || body["success"] != true {
+		t.Fatalf("second factor: %d %v", res.StatusCode, body)
+	}
+	if ts.cookie(t, c, "/", "token") == "" {
+		t.Fatal("no access token after the second factor")
+	}
+}
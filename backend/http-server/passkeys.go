@@ -0,0 +1,431 @@
+package httpserver
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	passkeyCeremonyTTL = 5 * time.Minute
+	maxPasskeyName     = 64
+)
+
+// newWebAuthn sets up passkeys for WEBAUTHN_RP_ID, by default the host of
+// APP_URL, accepting assertions from the comma separated WEBAUTHN_ORIGINS,
+// by default APP_URL itself.
+func newWebAuthn() (*webauthn.WebAuthn, error) {
+	app, err := url.Parse(appURL())
+	if err != nil {
+		return nil, err
+	}
+	rpId := os.Getenv("WEBAUTHN_RP_ID")
+	if rpId == "" {
+		rpId = app.Hostname()
+	}
+	origins := []string{strings.TrimSuffix(appURL(), "/")}
+	if v := os.Getenv("WEBAUTHN_ORIGINS"); v != "" {
+		origins = strings.Split(v, ",")
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpId,
+		RPDisplayName: totpIssuer,
+		RPOrigins:     origins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		},
+	})
+}
+
+// passkeyUser shows a user to the WebAuthn library. The user handle is
+// the user's id.
+type passkeyUser struct {
+	*t.MongoUser
+}
+
+func (u passkeyUser) WebAuthnID() []byte {
+	return u.ID[:]
+}
+
+func (u passkeyUser) WebAuthnName() string {
+	return u.Email
+}
+
+func (u passkeyUser) WebAuthnDisplayName() string {
+	return u.Name
+}
+
+func (u passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.Passkeys))
+	for _, passkey := range u.Passkeys {
+		transports := make([]protocol.AuthenticatorTransport, 0, len(passkey.Transports))
+		for _, transport := range passkey.Transports {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+		credentials = append(credentials, webauthn.Credential{
+			ID:              passkey.ID,
+			PublicKey:       passkey.PublicKey,
+			AttestationType: passkey.AttestationType,
+			Transport:       transports,
+			Flags:           webauthn.NewCredentialFlags(protocol.AuthenticatorFlags(passkey.Flags)),
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    passkey.AAGUID,
+				SignCount: passkey.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+type passkeyView struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastUsed  time.Time `json:"lastUsed,omitempty"`
+}
+
+func presentPasskey(passkey *t.Passkey) passkeyView {
+	return passkeyView{
+		ID:        base64.RawURLEncoding.EncodeToString(passkey.ID),
+		Name:      passkey.Name,
+		CreatedAt: passkey.CreatedAt,
+		LastUsed:  passkey.LastUsed,
+	}
+}
+
+// startCeremony keeps session until the second request of a registration
+// or login and returns the token that request must bring.
+func (s *Server) startCeremony(userId primitive.ObjectID, purpose, device string, session *webauthn.SessionData) (string, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	err = s.store.AddPasskeyCeremony(&t.PasskeyCeremony{
+		UserId:    userId,
+		Purpose:   purpose,
+		Hash:      hashToken(token),
+		Session:   data,
+		Device:    device,
+		ExpiresAt: time.Now().Add(passkeyCeremonyTTL),
+	})
+	return token, err
+}
+
+// finishCeremony takes back the state of a ceremony. On failure the
+// response is already written.
+func (s *Server) finishCeremony(w http.ResponseWriter, token, purpose string) (*t.PasskeyCeremony, *webauthn.SessionData, error) {
+	ceremony, err := s.store.ConsumePasskeyCeremony(hashToken(token), purpose)
+	if err != nil {
+		WriteJson(w, http.StatusUnauthorized, Response{
+			"err": "Invalid Or Expired Ceremony",
+		})
+		return nil, nil, err
+	}
+	session := new(webauthn.SessionData)
+	if err := json.Unmarshal(ceremony.Session, session); err != nil {
+		WriteJson(w, http.StatusInternalServerError, Response{
+			"success": false,
+		})
+		return nil, nil, err
+	}
+	return ceremony, session, nil
+}
+
+// passkeyStepUp guards adding and removing passkeys. With two factor
+// authentication on, a passkey logs in without the TOTP code, so a stolen
+// session must not be enough to add one, nor to remove the owner's. The
+// request then has to bring the password and a second factor, or just the
+// second factor for an account without a password. On failure the
+// response is already written.
+func (s *Server) passkeyStepUp(w http.ResponseWriter, r *http.Request, user *t.MongoUser) error {
+	if !user.TwoFactorEnabled() {
+		return nil
+	}
+	body := new(stepUp)
+	err := json.NewDecoder(r.Body).Decode(body)
+	if user.Password == "" {
+		if err != nil || (body.Code == "" && body.RecoveryCode == "") {
+			WriteJson(w, http.StatusUnauthorized, Response{
+				"err":       "Second Factor Required",
+				"twoFactor": true,
+			})
+			return errors.New("passkey change without step up")
+		}
+	} else if err != nil || body.Password == "" {
+		WriteJson(w, http.StatusUnauthorized, Response{
+			"err":       "Password And Second Factor Required",
+			"twoFactor": true,
+		})
+		return errors.New("passkey change without step up")
+	}
+	return s.confirmStepUp(w, user, body)
+}
+
+func (s *Server) handlePasskeyRoutes(router *mux.Router) {
+	router.HandleFunc("/passkeys", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		user, err := s.twoFactorUser(w, r)
+		if err != nil {
+			return err
+		}
+		passkeys := make([]passkeyView, 0, len(user.Passkeys))
+		for i := range user.Passkeys {
+			passkeys = append(passkeys, presentPasskey(&user.Passkeys[i]))
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success":  true,
+			"passkeys": passkeys,
+		})
+	}))).Methods(http.MethodGet)
+
+	router.HandleFunc("/passkeys/{passkeyid}", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		user, err := s.twoFactorUser(w, r)
+		if err != nil {
+			return err
+		}
+		id, err := base64.RawURLEncoding.DecodeString(mux.Vars(r)["passkeyid"])
+		if err != nil {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": err.Error(),
+			})
+		}
+		if err := s.passkeyStepUp(w, r, user); err != nil {
+			return err
+		}
+		removed, err := s.store.RemovePasskey(user.ID, id)
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		if !removed {
+			return WriteJson(w, http.StatusNotFound, Response{
+				"err": "Passkey Not Found",
+			})
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodDelete)
+
+	// Registration hands the browser the options for
+	// navigator.credentials.create and a ceremony token to send back with
+	// its answer.
+	router.HandleFunc("/passkeys/register/begin", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		user, err := s.twoFactorUser(w, r)
+		if err != nil {
+			return err
+		}
+		if err := s.passkeyStepUp(w, r, user); err != nil {
+			return err
+		}
+		pu := passkeyUser{user}
+		exclude := make([]protocol.CredentialDescriptor, 0, len(user.Passkeys))
+		for _, credential := range pu.WebAuthnCredentials() {
+			exclude = append(exclude, credential.Descriptor())
+		}
+		options, session, err := s.webauthn.BeginRegistration(pu, webauthn.WithExclusions(exclude))
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		token, err := s.startCeremony(user.ID, t.PasskeyRegistration, "", session)
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success":  true,
+			"ceremony": token,
+			"options":  options,
+		})
+	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/passkeys/register/finish", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		user, err := s.twoFactorUser(w, r)
+		if err != nil {
+			return err
+		}
+		body := new(struct {
+			Ceremony   string          `json:"ceremony"`
+			Name       string          `json:"name"`
+			Credential json.RawMessage `json:"credential"`
+		})
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil || body.Ceremony == "" {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Missing Ceremony",
+			})
+		}
+		ceremony, session, err := s.finishCeremony(w, body.Ceremony, t.PasskeyRegistration)
+		if err != nil {
+			return err
+		}
+		if ceremony.UserId != user.ID {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": "Invalid Or Expired Ceremony",
+			})
+		}
+		parsed, err := protocol.ParseCredentialCreationResponseBytes(body.Credential)
+		if err != nil {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Invalid Credential",
+			})
+		}
+		credential, err := s.webauthn.CreateCredential(passkeyUser{user}, *session, parsed)
+		if err != nil {
+			WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Invalid Credential",
+			})
+			return err
+		}
+		name := strings.TrimSpace(body.Name)
+		if name == "" {
+			name = describeDevice(r.UserAgent())
+		}
+		if len(name) > maxPasskeyName {
+			name = name[:maxPasskeyName]
+		}
+		transports := make([]string, 0, len(credential.Transport))
+		for _, transport := range credential.Transport {
+			transports = append(transports, string(transport))
+		}
+		passkey := &t.Passkey{
+			ID:              credential.ID,
+			Name:            name,
+			PublicKey:       credential.PublicKey,
+			AttestationType: credential.AttestationType,
+			Transports:      transports,
+			Flags:           byte(credential.Flags.ProtocolValue()),
+			AAGUID:          credential.Authenticator.AAGUID,
+			SignCount:       credential.Authenticator.SignCount,
+			CreatedAt:       time.Now(),
+		}
+		if err := s.store.AddPasskey(user.ID, passkey); err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+			"passkey": presentPasskey(passkey),
+		})
+	}))).Methods(http.MethodPost)
+
+	// Logging in needs no email: the browser offers the passkeys it has
+	// for us and the one picked names its user.
+	router.HandleFunc("/passkeys/login/begin", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		body := new(struct {
+			Device string `json:"device"`
+		})
+		if r.ContentLength != 0 {
+			json.NewDecoder(r.Body).Decode(body)
+		}
+		options, session, err := s.webauthn.BeginDiscoverableLogin(
+			webauthn.WithUserVerification(protocol.VerificationRequired),
+		)
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		token, err := s.startCeremony(primitive.NilObjectID, t.PasskeyLogin, body.Device, session)
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success":  true,
+			"ceremony": token,
+			"options":  options,
+		})
+	})).Methods(http.MethodPost)
+
+	// A passkey verified on the device is already two factors, so it skips
+	// the TOTP challenge.
+	router.HandleFunc("/passkeys/login/finish", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		body := new(struct {
+			Ceremony   string          `json:"ceremony"`
+			Credential json.RawMessage `json:"credential"`
+		})
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil || body.Ceremony == "" {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Missing Ceremony",
+			})
+		}
+		ceremony, session, err := s.finishCeremony(w, body.Ceremony, t.PasskeyLogin)
+		if err != nil {
+			return err
+		}
+		parsed, err := protocol.ParseCredentialRequestResponseBytes(body.Credential)
+		if err != nil {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Invalid Credential",
+			})
+		}
+		var user *t.MongoUser
+		credential, err := s.webauthn.ValidateDiscoverableLogin(func(rawId, userHandle []byte) (webauthn.User, error) {
+			if len(userHandle) != len(primitive.ObjectID{}) {
+				return nil, errors.New("unknown user handle")
+			}
+			found, err := s.store.FindUserById(primitive.ObjectID(userHandle))
+			if err != nil {
+				return nil, err
+			}
+			user = found
+			return passkeyUser{found}, nil
+		}, *session, parsed)
+		if err != nil {
+			WriteJson(w, http.StatusUnauthorized, Response{
+				"err": "Passkey Not Accepted",
+			})
+			return err
+		}
+		// A counter going backwards means the key may have been copied.
+		if credential.Authenticator.CloneWarning {
+			log.Printf("passkey of %s used with a stale counter, refusing it", user.ID.Hex())
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": "Passkey Not Accepted",
+			})
+		}
+		if err := s.store.UsePasskey(user.ID, credential.ID, credential.Authenticator.SignCount); err != nil {
+			log.Printf("UsePasskey %s: %v", user.ID.Hex(), err)
+		}
+		if err := s.startSession(w, r, user, ceremony.Device); err != nil {
+			WriteJson(w, http.StatusNotAcceptable, Response{
+				"success": false,
+			})
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	})).Methods(http.MethodPost)
+}
@@ -0,0 +1,446 @@
+package httpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// softAuthenticator is a passkey held in memory: it answers registration
+// and login options the way a platform authenticator would, with a "none"
+// attestation and an ES256 key.
+type softAuthenticator struct {
+	key        *ecdsa.PrivateKey
+	id         []byte
+	userHandle []byte
+	counter    uint32
+	// origin is what the browser would put in the client data.
+	origin string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, id: id, origin: appURL()}
+}
+
+// newSoftAuthenticatorAt is a passkey used from a page on origin.
+func newSoftAuthenticatorAt(t *testing.T, origin string) *softAuthenticator {
+	t.Helper()
+	a := newSoftAuthenticator(t)
+	a.origin = origin
+	return a
+}
+
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+func (a *softAuthenticator) authData(t *testing.T, rpId string, attested bool) []byte {
+	t.Helper()
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	data := append([]byte(nil), rpIdHash[:]...)
+	flags := byte(flagUserPresent | flagUserVerified)
+	if attested {
+		flags |= flagAttested
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.counter)
+	if !attested {
+		return data
+	}
+	point, err := a.key.PublicKey.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := point.Bytes() // 0x04 || x || y
+	cose, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: raw[1:33],
+		YCoord: raw[33:],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, make([]byte, 16)...) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+	data = append(data, a.id...)
+	return append(data, cose...)
+}
+
+func (a *softAuthenticator) clientData(typ string, challenge []byte) []byte {
+	data, _ := json.Marshal(map[string]any{
+		"type":      typ,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    a.origin,
+	})
+	return data
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// create answers the options of /passkeys/register/begin.
+func (a *softAuthenticator) create(t *testing.T, options any) json.RawMessage {
+	t.Helper()
+	creation := new(protocol.CredentialCreation)
+	remarshal(t, options, creation)
+	a.userHandle = creation.Response.User.ID.([]byte)
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(t, creation.Response.RelyingParty.ID, true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential, _ := json.Marshal(map[string]any{
+		"id":    b64(a.id),
+		"rawId": b64(a.id),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64(a.clientData("webauthn.create", creation.Response.Challenge)),
+			"attestationObject": b64(attestation),
+			"transports":        []string{"internal"},
+		},
+	})
+	return credential
+}
+
+// get answers the options of /passkeys/login/begin, counting the use.
+func (a *softAuthenticator) get(t *testing.T, options any) json.RawMessage {
+	t.Helper()
+	assertion := new(protocol.CredentialAssertion)
+	remarshal(t, options, assertion)
+	a.counter++
+	authData := a.authData(t, assertion.Response.RelyingPartyID, false)
+	clientData := a.clientData("webauthn.get", assertion.Response.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential, _ := json.Marshal(map[string]any{
+		"id":    b64(a.id),
+		"rawId": b64(a.id),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64(clientData),
+			"authenticatorData": b64(authData),
+			"signature":         b64(signature),
+			"userHandle":        b64(a.userHandle),
+		},
+	})
+	return credential
+}
+
+// remarshal decodes the options from a JSON answer into out.
+func remarshal(t *testing.T, in, out any) {
+	t.Helper()
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		t.Fatal(err)
+	}
+	// The user handle comes back as a base64url string.
+	if creation, ok := out.(*protocol.CredentialCreation); ok {
+		if id, ok := creation.Response.User.ID.(string); ok {
+			raw, err := base64.RawURLEncoding.DecodeString(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			creation.Response.User.ID = raw
+		}
+	}
+}
+
+// registerPasskey adds a passkey for the user logged in with c. stepUp is
+// sent with the request when not nil.
+func registerPasskey(t *testing.T, ts *testServer, c *http.Client, a *softAuthenticator, stepUp any) {
+	t.Helper()
+	res, body := ts.do(t, c, http.MethodPost, "/auth/passkeys/register/begin", stepUp)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("register/begin: %d %v", res.StatusCode, body)
+	}
+	res, body = ts.do(t, c, http.MethodPost, "/auth/passkeys/register/finish", Response{
+		"ceremony":   body["ceremony"],
+		"name":       "Test Key",
+		"credential": a.create(t, body["options"]),
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("register/finish: %d %v", res.StatusCode, body)
+	}
+}
+
+// beginPasskeyLogin starts a login and returns its ceremony and options.
+func beginPasskeyLogin(t *testing.T, ts *testServer) (string, any) {
+	t.Helper()
+	res, body := ts.do(t, ts.client(t), http.MethodPost, "/auth/passkeys/login/begin", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("login/begin: %d %v", res.StatusCode, body)
+	}
+	return body["ceremony"].(string), body["options"]
+}
+
+// passkeyLogin logs in with a and returns the answer to login/finish.
+func passkeyLogin(t *testing.T, ts *testServer, a *softAuthenticator) (*http.Client, *http.Response, Response) {
+	t.Helper()
+	ceremony, options := beginPasskeyLogin(t, ts)
+	c := ts.client(t)
+	res, body := ts.do(t, c, http.MethodPost, "/auth/passkeys/login/finish", Response{
+		"ceremony":   ceremony,
+		"credential": a.get(t, options),
+	})
+	return c, res, body
+}
+
+func TestPasskeyRegisterAndLogin(t *testing.T) {
+	ts := newTestServer(t)
+	user := ts.addUser(t, "alice@example.com", "hunter22")
+	c := ts.login(t, "alice@example.com", "hunter22")
+	key := newSoftAuthenticator(t)
+	registerPasskey(t, ts, c, key, nil)
+
+	stored, err := ts.store.FindUserById(user.ID)
+	if err != nil || len(stored.Passkeys) != 1 {
+		t.Fatalf("stored passkeys: %v (%v)", stored.Passkeys, err)
+	}
+	loggedIn, res, body := passkeyLogin(t, ts, key)
+	if res.StatusCode != http.StatusOK || body["success"] != true {
+		t.Fatalf("login/finish: %d %v", res.StatusCode, body)
+	}
+	res, body = ts.do(t, loggedIn, http.MethodGet, "/api/user/me", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("user/me after a passkey login: %d %v", res.StatusCode, body)
+	}
+	if me := body["user"].(map[string]any); me["email"] != "alice@example.com" {
+		t.Fatalf("logged in as %v", me["email"])
+	}
+}
+
+func TestPasskeyMultiple(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, "bob@example.com", "hunter22")
+	c := ts.login(t, "bob@example.com", "hunter22")
+	laptop, phone := newSoftAuthenticator(t), newSoftAuthenticator(t)
+	registerPasskey(t, ts, c, laptop, nil)
+
+	// The options for a second passkey exclude the first.
+	res, body := ts.do(t, c, http.MethodPost, "/auth/passkeys/register/begin", nil)
+	creation := new(protocol.CredentialCreation)
+	remarshal(t, body["options"], creation)
+	if excluded := creation.Response.CredentialExcludeList; len(excluded) != 1 || b64(excluded[0].CredentialID) != b64(laptop.id) {
+		t.Fatalf("excluded credentials: %+v", excluded)
+	}
+	registerPasskey(t, ts, c, phone, nil)
+
+	res, body = ts.do(t, c, http.MethodGet, "/auth/passkeys", nil)
+	if passkeys, _ := body["passkeys"].([]any); res.StatusCode != http.StatusOK || len(passkeys) != 2 {
+		t.Fatalf("passkeys: %d %v", res.StatusCode, body)
+	}
+	for name, key := range map[string]*softAuthenticator{"laptop": laptop, "phone": phone} {
+		if _, res, body := passkeyLogin(t, ts, key); res.StatusCode != http.StatusOK {
+			t.Fatalf("login with the %s: %d %v", name, res.StatusCode, body)
+		}
+	}
+
+	requireMongoDB(t, "$pull with a condition")
+	res, body = ts.do(t, c, http.MethodDelete, "/auth/passkeys/"+b64(laptop.id), nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("delete: %d %v", res.StatusCode, body)
+	}
+	if _, res, _ := passkeyLogin(t, ts, laptop); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("login with a deleted passkey: %d", res.StatusCode)
+	}
+	if _, res, body := passkeyLogin(t, ts, phone); res.StatusCode != http.StatusOK {
+		t.Fatalf("login with the remaining passkey: %d %v", res.StatusCode, body)
+	}
+}
+
+func TestPasskeyReplayedCeremony(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, "carol@example.com", "hunter22")
+	c := ts.login(t, "carol@example.com", "hunter22")
+	key := newSoftAuthenticator(t)
+	registerPasskey(t, ts, c, key, nil)
+
+	ceremony, options := beginPasskeyLogin(t, ts)
+	answer := Response{"ceremony": ceremony, "credential": key.get(t, options)}
+	if res, body := ts.do(t, ts.client(t), http.MethodPost, "/auth/passkeys/login/finish", answer); res.StatusCode != http.StatusOK {
+		t.Fatalf("login/finish: %d %v", res.StatusCode, body)
+	}
+	res, body := ts.do(t, ts.client(t), http.MethodPost, "/auth/passkeys/login/finish", answer)
+	if res.StatusCode != http.StatusUnauthorized || body["err"] != "Invalid Or Expired Ceremony" {
+		t.Fatalf("replayed login: %d %v", res.StatusCode, body)
+	}
+
+	// A registration ceremony works once as well.
+	other := newSoftAuthenticator(t)
+	res, body = ts.do(t, c, http.MethodPost, "/auth/passkeys/register/begin", nil)
+	answer = Response{"ceremony": body["ceremony"], "credential": other.create(t, body["options"])}
+	if res, body := ts.do(t, c, http.MethodPost, "/auth/passkeys/register/finish", answer); res.StatusCode != http.StatusOK {
+		t.Fatalf("register/finish: %d %v", res.StatusCode, body)
+	}
+	if res, _ := ts.do(t, c, http.MethodPost, "/auth/passkeys/register/finish", answer); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("replayed registration: %d", res.StatusCode)
+	}
+}
+
+func TestPasskeyCloneWarning(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, "dave@example.com", "hunter22")
+	c := ts.login(t, "dave@example.com", "hunter22")
+	key := newSoftAuthenticator(t)
+	key.counter = 10
+	registerPasskey(t, ts, c, key, nil)
+
+	// A copy of the key keeps its own counter, which falls behind.
+	clone := *key
+	clone.counter = 4
+	_, res, body := passkeyLogin(t, ts, &clone)
+	if res.StatusCode != http.StatusUnauthorized || body["err"] != "Passkey Not Accepted" {
+		t.Fatalf("login with a stale counter: %d %v", res.StatusCode, body)
+	}
+	if _, res, body := passkeyLogin(t, ts, key); res.StatusCode != http.StatusOK {
+		t.Fatalf("login with the key itself: %d %v", res.StatusCode, body)
+	}
+
+	// Logins move the stored counter along, so a counter the key has
+	// already used is refused too.
+	requireMongoDB(t, "the positional $ update")
+	clone.counter = key.counter - 1
+	_, res, body = passkeyLogin(t, ts, &clone)
+	if res.StatusCode != http.StatusUnauthorized || body["err"] != "Passkey Not Accepted" {
+		t.Fatalf("login repeating a used counter: %d %v", res.StatusCode, body)
+	}
+}
+
+func TestPasskeyWrongOrigin(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, "erin@example.com", "hunter22")
+	c := ts.login(t, "erin@example.com", "hunter22")
+	key := newSoftAuthenticator(t)
+	registerPasskey(t, ts, c, key, nil)
+
+	key.origin = "https://glooo.example.net"
+	_, res, body := passkeyLogin(t, ts, key)
+	if res.StatusCode != http.StatusUnauthorized || body["err"] != "Passkey Not Accepted" {
+		t.Fatalf("login from another origin: %d %v", res.StatusCode, body)
+	}
+
+	res, body = ts.do(t, c, http.MethodPost, "/auth/passkeys/register/begin", nil)
+	res, body = ts.do(t, c, http.MethodPost, "/auth/passkeys/register/finish", Response{
+		"ceremony":   body["ceremony"],
+		"credential": newSoftAuthenticatorAt(t, "https://glooo.example.net").create(t, body["options"]),
+	})
+	if res.StatusCode != http.StatusNotAcceptable {
+		t.Fatalf("registration from another origin: %d %v", res.StatusCode, body)
+	}
+}
+
+func TestPasskeyChangesNeedStepUpWithTwoFactor(t *testing.T) {
+	ts := newTestServer(t)
+	user := ts.addUser(t, "frank@example.com", "hunter22")
+	key := newSoftAuthenticator(t)
+	registerPasskey(t, ts, ts.login(t, "frank@example.com", "hunter22"), key, nil)
+	secret := enableTOTP(t, ts, user, "recovery-one")
+
+	// A passkey login skips the TOTP code, which is why the session it
+	// gives cannot add or remove passkeys alone.
+	c, res, body := passkeyLogin(t, ts, key)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("passkey login with 2FA on: %d %v", res.StatusCode, body)
+	}
+	for _, attempt := range []struct {
+		name string
+		body any
+	}{
+		{"nothing", nil},
+		{"password only", Response{"password": "hunter22"}},
+		{"wrong password", Response{"password": "hunter23", "code": currentCode(t, secret)}},
+		{"wrong code", Response{"password": "hunter22", "code": wrongCode(t, secret)}},
+	} {
+		if res, body := ts.do(t, c, http.MethodPost, "/auth/passkeys/register/begin", attempt.body); res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("register/begin with %s: %d %v", attempt.name, res.StatusCode, body)
+		}
+		if res, body := ts.do(t, c, http.MethodDelete, "/auth/passkeys/"+b64(key.id), attempt.body); res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("delete with %s: %d %v", attempt.name, res.StatusCode, body)
+		}
+	}
+
+	second := newSoftAuthenticator(t)
+	registerPasskey(t, ts, c, second, Response{"password": "hunter22", "code": currentCode(t, secret)})
+	requireMongoDB(t, "$pull with a condition")
+	res, body = ts.do(t, c, http.MethodDelete, "/auth/passkeys/"+b64(key.id), Response{
+		"password":     "hunter22",
+		"recoveryCode": "recovery-one",
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("delete with the password and a recovery code: %d %v", res.StatusCode, body)
+	}
+	stored, err := ts.store.FindUserById(user.ID)
+	if err != nil || len(stored.Passkeys) != 1 || b64(stored.Passkeys[0].ID) != b64(second.id) {
+		t.Fatalf("passkeys after the changes: %v (%v)", stored.Passkeys, err)
+	}
+}
+
+func TestPasskeyStepUpWithoutPassword(t *testing.T) {
+	ts := newTestServer(t)
+	user := ts.addUser(t, "grace@example.com", "hunter22")
+	c := ts.login(t, "grace@example.com", "hunter22")
+	secret := enableTOTP(t, ts, user, "recovery-one")
+	// Like an account made through a login provider.
+	if err := ts.store.UpdateUserDetails(user.ID, "password", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, attempt := range []struct {
+		name string
+		body any
+		err  string
+	}{
+		{"nothing", nil, "Second Factor Required"},
+		{"a password", Response{"password": "hunter22"}, "Second Factor Required"},
+		{"a wrong code", Response{"code": wrongCode(t, secret)}, "Invalid Code"},
+	} {
+		res, body := ts.do(t, c, http.MethodPost, "/auth/passkeys/register/begin", attempt.body)
+		if res.StatusCode != http.StatusUnauthorized || body["err"] != attempt.err {
+			t.Fatalf("register/begin with %s: %d %v", attempt.name, res.StatusCode, body)
+		}
+	}
+
+	key := newSoftAuthenticator(t)
+	registerPasskey(t, ts, c, key, Response{"code": currentCode(t, secret)})
+	requireMongoDB(t, "$pull with a condition")
+	res, body := ts.do(t, c, http.MethodDelete, "/auth/passkeys/"+b64(key.id), Response{
+		"recoveryCode": "recovery-one",
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("delete with a recovery code: %d %v", res.StatusCode, body)
+	}
+}
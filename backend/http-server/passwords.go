@@ -0,0 +1,124 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/mailer"
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/gorilla/mux"
+)
+
+const passwordResetTTL = time.Hour
+
+// sendPasswordReset emails user a link to choose a new password.
+func (s *Server) sendPasswordReset(ctx context.Context, user *t.MongoUser) error {
+	token, err := s.newEmailToken(user.ID, t.PasswordReset, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+	link := appURL() + "/reset-password?token=" + url.QueryEscape(token)
+	return s.mailer.Send(ctx, &mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Text: fmt.Sprintf("Hi %s,\n\nOpen this link to choose a new password:\n\n%s\n\n"+
+			"The link works once, for an hour. If you did not ask for it, ignore this email.\n",
+			user.Name, link),
+	})
+}
+
+func (s *Server) handlePasswordRoutes(router *mux.Router) {
+	// The answer is the same whether or not the address has an account,
+	// and the email goes out in the background so the timing does not
+	// tell either.
+	router.HandleFunc("/forgot-password", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		body := new(struct {
+			Email string `json:"email"`
+		})
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil || body.Email == "" {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Missing Email",
+			})
+		}
+		go func() {
+			user, err := s.store.FindUserByEmail(body.Email)
+			if err != nil {
+				return
+			}
+			unlock := s.emailLocks.lock(user.ID)
+			defer unlock()
+			wait, err := s.emailWait(user.ID, t.PasswordReset)
+			if err != nil || wait > 0 {
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := s.sendPasswordReset(ctx, user); err != nil {
+				log.Printf("sendPasswordReset %s: %v", user.ID.Hex(), err)
+			}
+		}()
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+			"message": "If The Email Has An Account, A Reset Link Was Sent",
+		})
+	})).Methods(http.MethodPost)
+
+	// Resetting the password logs the account out everywhere, in case the
+	// old one was stolen.
+	router.HandleFunc("/reset-password", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		body := new(struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		})
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil || body.Token == "" {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Missing Token",
+			})
+		}
+		if body.Password == "" {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Missing Password",
+			})
+		}
+		// bcrypt refuses anything longer.
+		if len(body.Password) > 72 {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Password Too Long",
+			})
+		}
+		token, err := s.store.ConsumeEmailToken(hashToken(body.Token), t.PasswordReset)
+		if err != nil {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Invalid Or Expired Token",
+			})
+		}
+		if err := s.store.SetUserPassword(token.UserId, body.Password); err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		if err := s.store.DeleteEmailTokens(token.UserId, t.PasswordReset); err != nil {
+			log.Printf("DeleteEmailTokens %s: %v", token.UserId.Hex(), err)
+		}
+		// The link reached the inbox, which confirms the address too.
+		if err := s.store.MarkUserVerified(token.UserId); err != nil {
+			log.Printf("MarkUserVerified %s: %v", token.UserId.Hex(), err)
+		}
+		if err := s.revokeAllSessions(token.UserId); err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		clearAuthCookies(w)
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	})).Methods(http.MethodPost)
+}
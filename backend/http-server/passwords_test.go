@@ -0,0 +1,82 @@
+package httpserver
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForMail waits until addr was sent at least n emails and then a
+// little longer, in case more are on their way.
+func waitForMail(t *testing.T, ts *testServer, addr string, n int) int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ts.mail.to(addr)) < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+	return len(ts.mail.to(addr))
+}
+
+func TestForgotPasswordThrottleIsAtomic(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, "alice@example.com", "old password")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// t.Fatal may not be called from here, so no ts.do.
+			res, err := http.Post(ts.URL+"/auth/forgot-password", "application/json",
+				strings.NewReader(`{"email":"alice@example.com"}`))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("forgot-password: %d", res.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := waitForMail(t, ts, "alice@example.com", 1); n != 1 {
+		t.Fatalf("concurrent requests sent %d reset emails, want 1", n)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, "bob@example.com", "old password")
+	old := ts.login(t, "bob@example.com", "old password")
+
+	ts.do(t, ts.client(t), http.MethodPost, "/auth/forgot-password", Response{"email": "bob@example.com"})
+	ts.do(t, ts.client(t), http.MethodPost, "/auth/forgot-password", Response{"email": "nobody@example.com"})
+	if n := waitForMail(t, ts, "bob@example.com", 1); n != 1 {
+		t.Fatalf("sent %d reset emails, want 1", n)
+	}
+	token := tokenIn(t, ts.mail.to("bob@example.com")[0])
+
+	res, body := ts.do(t, ts.client(t), http.MethodPost, "/auth/reset-password", Response{
+		"token":    token,
+		"password": "new password",
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("reset: %d %v", res.StatusCode, body)
+	}
+	res, _ = ts.do(t, old, http.MethodGet, "/api/user/me", nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("old login still works after a reset: %d", res.StatusCode)
+	}
+	ts.login(t, "bob@example.com", "new password")
+	res, _ = ts.do(t, ts.client(t), http.MethodPost, "/auth/reset-password", Response{
+		"token":    token,
+		"password": "another password",
+	})
+	if res.StatusCode != http.StatusNotAcceptable {
+		t.Fatalf("reset token worked twice: %d", res.StatusCode)
+	}
+}
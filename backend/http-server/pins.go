@@ -0,0 +1,142 @@
+package httpserver
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/SourishBeast7/Glooo/db"
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type pinEvent struct {
+	ChatId    primitive.ObjectID `json:"chatid"`
+	MessageId primitive.ObjectID `json:"messageId"`
+	UserId    primitive.ObjectID `json:"userId"`
+	Pinned    []t.PinnedMessage  `json:"pinned"`
+}
+
+func (s *Server) handlePinRoutes(router *mux.Router) {
+	router.HandleFunc("/chat/{chatid}/pins/{msgid}", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		chat, msg, userId, err := s.pinRequest(w, r)
+		if err != nil {
+			return err
+		}
+		chat, err = s.store.PinMessage(chat.ID, t.PinnedMessage{
+			MessageId: msg.ID,
+			PinnedBy:  userId,
+		})
+		if err != nil {
+			return writeStoreError(w, err)
+		}
+		return s.announcePin(w, chat, msg, userId, "pin.add", "pinned a message")
+	}))).Methods(http.MethodPut)
+
+	router.HandleFunc("/chat/{chatid}/pins/{msgid}", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		chat, msg, userId, err := s.pinRequest(w, r)
+		if err != nil {
+			return err
+		}
+		if !chat.IsPinned(msg.ID) {
+			return WriteJson(w, http.StatusNotFound, Response{
+				"err": "Message Is Not Pinned",
+			})
+		}
+		chat, err = s.store.UnpinMessage(chat.ID, msg.ID)
+		if err != nil {
+			return writeStoreError(w, err)
+		}
+		return s.announcePin(w, chat, msg, userId, "pin.remove", "unpinned a message")
+	}))).Methods(http.MethodDelete)
+}
+
+// pinRequest checks that the user may change pins in {chatid}: admins in
+// groups, either participant in direct chats. On failure the error response
+// is already written.
+func (s *Server) pinRequest(w http.ResponseWriter, r *http.Request) (*t.Chats, *t.Message, primitive.ObjectID, error) {
+	vars := mux.Vars(r)
+	userId, err := currentUserId(r)
+	if err != nil {
+		WriteJson(w, http.StatusUnauthorized, Response{
+			"err": err.Error(),
+		})
+		return nil, nil, userId, err
+	}
+	chat, err := s.chatForUser(vars["chatid"], userId)
+	if err != nil {
+		WriteJson(w, http.StatusForbidden, Response{
+			"err": "Chat Not Found",
+		})
+		return nil, nil, userId, err
+	}
+	if chat.Group && !chat.IsAdmin(userId) {
+		err := errors.New("only admins can pin messages in groups")
+		WriteJson(w, http.StatusForbidden, Response{
+			"err": "Only Admins Can Pin Messages",
+		})
+		return nil, nil, userId, err
+	}
+	msgId, err := primitive.ObjectIDFromHex(vars["msgid"])
+	if err != nil {
+		WriteJson(w, http.StatusNotAcceptable, Response{
+			"err": err.Error(),
+		})
+		return nil, nil, userId, err
+	}
+	msg := s.store.FindMessagesById(msgId)
+	if msg == nil || msg.ChatId != chat.ID || msg.System {
+		err := errors.New("message not found in chat")
+		WriteJson(w, http.StatusNotFound, Response{
+			"err": "Message Not Found",
+		})
+		return nil, nil, userId, err
+	}
+	return chat, msg, userId, nil
+}
+
+// announcePin posts the system message and realtime event for a pin change
+// and writes the updated pin list as the response.
+func (s *Server) announcePin(w http.ResponseWriter, chat *t.Chats, msg *t.Message, userId primitive.ObjectID, eventType string, text string) error {
+	notice := &t.Message{
+		Data:    text,
+		From:    userId,
+		ChatId:  chat.ID,
+		ReplyTo: &msg.ID,
+		System:  true,
+	}
+	if _, err := s.store.AddMessage(notice); err != nil {
+		return err
+	}
+	notice.Quote = db.QuoteOf(msg)
+	s.emitMessage(chat, notice)
+	s.emitToChat(chat, &t.Event{
+		Type: eventType,
+		Data: pinEvent{
+			ChatId:    chat.ID,
+			MessageId: msg.ID,
+			UserId:    userId,
+			Pinned:    chat.Pinned,
+		},
+	})
+	return WriteJson(w, http.StatusOK, Response{
+		"success": true,
+		"pinned":  chat.Pinned,
+	})
+}
+
+// writeStoreError answers with the code carried by a db.MyError, or a
+// generic failure for anything else.
+func writeStoreError(w http.ResponseWriter, err error) error {
+	var e *db.MyError
+	if errors.As(err, &e) {
+		return WriteJson(w, e.Code, Response{
+			"err": e.Message,
+		})
+	}
+	WriteJson(w, http.StatusInternalServerError, Response{
+		"success": false,
+	})
+	return err
+}
@@ -0,0 +1,108 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"unicode"
+	"unicode/utf8"
+
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const maxEmojiLength = 32
+
+type reactionRequest struct {
+	Emoji string `json:"emoji"`
+}
+
+type reactionEvent struct {
+	ChatId    primitive.ObjectID `json:"chatid"`
+	MessageId primitive.ObjectID `json:"messageId"`
+	UserId    primitive.ObjectID `json:"userId"`
+	Emoji     string             `json:"emoji"`
+	Reactions []t.Reaction       `json:"reactions"`
+}
+
+// validEmoji accepts short runs of non-ASCII symbols such as emoji with
+// skin tone modifiers or ZWJ sequences, and rejects plain text.
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) {
+		return false
+	}
+	for _, r := range emoji {
+		if r < utf8.RuneSelf || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) handleReactionRoutes(router *mux.Router) {
+	router.HandleFunc("/chat/{chatid}/messages/{msgid}/reactions", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return s.react(w, r, "reaction.add", s.store.AddReaction)
+	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/chat/{chatid}/messages/{msgid}/reactions", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return s.react(w, r, "reaction.remove", s.store.RemoveReaction)
+	}))).Methods(http.MethodDelete)
+}
+
+func (s *Server) react(w http.ResponseWriter, r *http.Request, eventType string, update func(msgId, userId primitive.ObjectID, emoji string) (*t.Message, error)) error {
+	vars := mux.Vars(r)
+	userId, err := currentUserId(r)
+	if err != nil {
+		return WriteJson(w, http.StatusUnauthorized, Response{
+			"err": err.Error(),
+		})
+	}
+	chat, err := s.chatForUser(vars["chatid"], userId)
+	if err != nil {
+		WriteJson(w, http.StatusForbidden, Response{
+			"err": "Chat Not Found",
+		})
+		return err
+	}
+	msgId, err := primitive.ObjectIDFromHex(vars["msgid"])
+	if err != nil {
+		return WriteJson(w, http.StatusNotAcceptable, Response{
+			"err": err.Error(),
+		})
+	}
+	if msg := s.store.FindMessagesById(msgId); msg == nil || msg.ChatId != chat.ID {
+		return WriteJson(w, http.StatusNotFound, Response{
+			"err": "Message Not Found",
+		})
+	}
+	body := new(reactionRequest)
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		return WriteJson(w, http.StatusNotAcceptable, Response{
+			"err": err.Error(),
+		})
+	}
+	if !validEmoji(body.Emoji) {
+		return WriteJson(w, http.StatusNotAcceptable, Response{
+			"err": "Invalid Emoji",
+		})
+	}
+	msg, err := update(msgId, userId, body.Emoji)
+	if err != nil {
+		return writeStoreError(w, err)
+	}
+	s.emitToChat(chat, &t.Event{
+		Type: eventType,
+		Data: reactionEvent{
+			ChatId:    chat.ID,
+			MessageId: msgId,
+			UserId:    userId,
+			Emoji:     body.Emoji,
+			Reactions: msg.Reactions,
+		},
+	})
+	return WriteJson(w, http.StatusOK, Response{
+		"success":   true,
+		"reactions": msg.Reactions,
+	})
+}
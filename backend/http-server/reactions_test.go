@@ -0,0 +1,82 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/SourishBeast7/Glooo/db"
+	types "github.com/SourishBeast7/Glooo/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// addMessage stores a text message from user in chat.
+func addMessage(t *testing.T, ts *testServer, chat *types.Chats, from *types.MongoUser) *types.Message {
+	t.Helper()
+	msg := &types.Message{Data: "hello", From: from.ID, ChatId: chat.ID}
+	if _, err := ts.store.AddMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// addChat makes a chat between users.
+func addChat(t *testing.T, ts *testServer, users ...*types.MongoUser) *types.Chats {
+	t.Helper()
+	ids := make([]primitive.ObjectID, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	chatId, ok := ts.store.CreateChat(ids...)
+	if !ok {
+		t.Fatal("CreateChat failed")
+	}
+	return &types.Chats{ID: chatId, Participants: ids}
+}
+
+func wantStoreError(t *testing.T, err error, code int) {
+	t.Helper()
+	var e *db.MyError
+	if !errors.As(err, &e) || e.Code != code {
+		t.Fatalf("got %v, want a %d", err, code)
+	}
+}
+
+func TestReactionOnDeletedMessage(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.addUser(t, "alice@example.com", "hunter22")
+	bob := ts.addUser(t, "bob@example.com", "hunter22")
+	chat := addChat(t, ts, alice, bob)
+	msg := addMessage(t, ts, chat, alice)
+	if err := ts.store.DeleteMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// The store is asked after the handler found the message, as when it
+	// is deleted between the two.
+	_, err := ts.store.AddReaction(msg.ID, bob.ID, "👍")
+	wantStoreError(t, err, http.StatusNotFound)
+
+	c := ts.login(t, "bob@example.com", "hunter22")
+	res, body := ts.do(t, c, http.MethodPost, fmt.Sprintf("/chat/%s/messages/%s/reactions", chat.ID.Hex(), msg.ID.Hex()), Response{
+		"emoji": "👍",
+	})
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("reaction on a deleted message: %d %v", res.StatusCode, body)
+	}
+}
+
+func TestReactionLimit(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.addUser(t, "alice@example.com", "hunter22")
+	chat := addChat(t, ts, alice)
+	msg := addMessage(t, ts, chat, alice)
+	for i := 0; i < db.MaxReactionsPerMessage; i++ {
+		if _, err := ts.store.AddReaction(msg.ID, alice.ID, fmt.Sprintf("emoji-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := ts.store.AddReaction(msg.ID, alice.ID, "one too many")
+	wantStoreError(t, err, http.StatusConflict)
+}
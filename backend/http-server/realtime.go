@@ -0,0 +1,113 @@
+package httpserver
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const writeWait = 10 * time.Second
+
+// client is one websocket connection of a user. Writes go through send so
+// that events emitted from different requests never interleave on the wire.
+type client struct {
+	conn      *websocket.Conn
+	userId    primitive.ObjectID
+	sessionId primitive.ObjectID
+	mutex     sync.Mutex
+}
+
+func (c *client) send(v any) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteJSON(v)
+}
+
+// close tells the client why it is being disconnected and hangs up, which
+// ends its readLoop.
+func (c *client) close(code int, reason string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	c.conn.Close()
+}
+
+func (s *Server) wsConnHandler(w http.ResponseWriter, r *http.Request) error {
+	log.Println("➡️ Incoming WebSocket request...")
+	principal, ok := m.PrincipalFrom(r.Context())
+	if !ok {
+		return WriteJson(w, http.StatusUnauthorized, Response{
+			"err": "Request Is Not Authenticated",
+		})
+	}
+	userId := principal.UserId
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("❌ WebSocket upgrade failed:", err)
+		return err
+	}
+	log.Println("✅ WebSocket connection upgraded")
+
+	c := &client{
+		conn:      conn,
+		userId:    userId,
+		sessionId: principal.SessionId,
+	}
+	s.mutex.Lock()
+	if s.conn[userId] == nil {
+		s.conn[userId] = make(map[*client]bool)
+	}
+	s.conn[userId][c] = true
+	s.mutex.Unlock()
+
+	go s.readLoop(c)
+	return nil
+}
+
+// readLoop keeps the connection alive until the client goes away. Everything
+// the client wants to change goes through the REST routes, so incoming frames
+// are discarded.
+func (s *Server) readLoop(c *client) {
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conn[c.userId], c)
+		if len(s.conn[c.userId]) == 0 {
+			delete(s.conn, c.userId)
+		}
+		s.mutex.Unlock()
+		c.conn.Close()
+	}()
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// emit sends the event to every open connection of the given users.
+func (s *Server) emit(userIds []primitive.ObjectID, event *t.Event) {
+	s.mutex.RLock()
+	clients := make([]*client, 0)
+	for _, id := range userIds {
+		for c := range s.conn[id] {
+			clients = append(clients, c)
+		}
+	}
+	s.mutex.RUnlock()
+	for _, c := range clients {
+		if err := c.send(event); err != nil {
+			log.Printf("emit %s to %s failed: %v", event.Type, c.userId.Hex(), err)
+		}
+	}
+}
+
+func (s *Server) emitToChat(chat *t.Chats, event *t.Event) {
+	s.emit(chat.Participants, event)
+}
@@ -0,0 +1,188 @@
+package httpserver
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db"
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Sessions found not to be revoked are trusted for this long before
+	// the database is asked again, which bounds how late a logout made
+	// on another server is noticed.
+	revocationRecheck = 30 * time.Second
+	closeSessionEnded = 4001
+)
+
+// revocationCache is the list AuthMiddleWare checks on every request. Known
+// revocations are kept until they run out.
+type revocationCache struct {
+	store   *db.Store
+	mutex   sync.Mutex
+	revoked map[primitive.ObjectID]time.Time
+	checked map[primitive.ObjectID]time.Time
+}
+
+func newRevocationCache(store *db.Store) *revocationCache {
+	return &revocationCache{
+		store:   store,
+		revoked: make(map[primitive.ObjectID]time.Time),
+		checked: make(map[primitive.ObjectID]time.Time),
+	}
+}
+
+func (c *revocationCache) IsRevoked(sessionId primitive.ObjectID) bool {
+	now := time.Now()
+	c.mutex.Lock()
+	if until, ok := c.revoked[sessionId]; ok && now.Before(until) {
+		c.mutex.Unlock()
+		return true
+	}
+	if at, ok := c.checked[sessionId]; ok && now.Sub(at) < revocationRecheck {
+		c.mutex.Unlock()
+		return false
+	}
+	c.mutex.Unlock()
+
+	session, err := c.store.FindRevokedSession(sessionId)
+	if err != nil {
+		// Refuse rather than let a logged out session through.
+		log.Printf("FindRevokedSession %s: %v", sessionId.Hex(), err)
+		return true
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if session != nil {
+		c.revoked[sessionId] = session.Until
+		return true
+	}
+	c.checked[sessionId] = now
+	return false
+}
+
+func (c *revocationCache) add(sessionId primitive.ObjectID, until time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.revoked[sessionId] = until
+	delete(c.checked, sessionId)
+}
+
+// prune forgets revocations that ran out and stale checks.
+func (c *revocationCache) prune() {
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, until := range c.revoked {
+		if now.After(until) {
+			delete(c.revoked, id)
+		}
+	}
+	for id, at := range c.checked {
+		if now.Sub(at) >= revocationRecheck {
+			delete(c.checked, id)
+		}
+	}
+}
+
+func (s *Server) pruneRevocations() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.revoked.prune()
+	}
+}
+
+// revokeSessions ends logins of a user: their refresh tokens stop working,
+// their access tokens are refused and their websockets are closed.
+func (s *Server) revokeSessions(userId primitive.ObjectID, sessionIds ...primitive.ObjectID) error {
+	// Access tokens issued just before the revocation expire at the latest
+	// one TTL from now.
+	until := time.Now().Add(s.accessTTL)
+	for _, id := range sessionIds {
+		// The revocation is recorded before the refresh tokens are
+		// revoked: a /refresh racing with us either has its new token
+		// revoked below or finds the record in issueTokens.
+		if err := s.store.RevokeSession(&t.RevokedSession{
+			ID:     id,
+			UserId: userId,
+			Until:  until,
+		}); err != nil {
+			return err
+		}
+		s.revoked.add(id, until)
+		if err := s.store.EndSession(id); err != nil {
+			return err
+		}
+		if err := s.store.RevokeTokenFamily(id); err != nil {
+			return err
+		}
+	}
+	s.disconnectSessions(userId, sessionIds...)
+	return nil
+}
+
+// revokeAllSessions logs a user out everywhere.
+func (s *Server) revokeAllSessions(userId primitive.ObjectID, current ...primitive.ObjectID) error {
+	families, err := s.store.FindActiveFamilies(userId)
+	if err != nil {
+		return err
+	}
+	return s.revokeSessions(userId, append(families, current...)...)
+}
+
+// disconnectSessions closes the websockets opened with tokens of the given
+// sessions.
+func (s *Server) disconnectSessions(userId primitive.ObjectID, sessionIds ...primitive.ObjectID) {
+	ended := make(map[primitive.ObjectID]bool)
+	for _, id := range sessionIds {
+		ended[id] = true
+	}
+	s.mutex.RLock()
+	clients := make([]*client, 0)
+	for c := range s.conn[userId] {
+		if ended[c.sessionId] {
+			clients = append(clients, c)
+		}
+	}
+	s.mutex.RUnlock()
+	for _, c := range clients {
+		c.close(closeSessionEnded, "Session Ended")
+	}
+}
+
+func (s *Server) handleLogoutRoutes(router *mux.Router) {
+	router.HandleFunc("/logout", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		principal, _ := m.PrincipalFrom(r.Context())
+		if err := s.revokeSessions(principal.UserId, principal.SessionId); err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		clearAuthCookies(w)
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/logout-all", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		principal, _ := m.PrincipalFrom(r.Context())
+		if err := s.revokeAllSessions(principal.UserId, principal.SessionId); err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		clearAuthCookies(w)
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPost)
+}
@@ -0,0 +1,145 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/scanner"
+	"github.com/SourishBeast7/Glooo/storage"
+	t "github.com/SourishBeast7/Glooo/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	scanTimeout       = 5 * time.Minute
+	scanRetryInterval = 5 * time.Minute
+)
+
+type attachmentEvent struct {
+	ChatId     primitive.ObjectID `json:"chatid"`
+	MessageId  primitive.ObjectID `json:"messageId"`
+	Attachment *t.Attachment      `json:"attachment"`
+}
+
+// scanAttachments runs the pending attachments of a new message through
+// the scanner. Until then only the sender can see them.
+func (s *Server) scanAttachments(message *t.Message) {
+	for i := range message.Attachments {
+		if message.Attachments[i].Status == t.AttachmentPending {
+			s.scanAttachment(message, &message.Attachments[i])
+		}
+	}
+}
+
+func (s *Server) scanAttachment(message *t.Message, attachment *t.Attachment) {
+	ctx, cancel := context.WithTimeout(context.Background(), scanTimeout)
+	defer cancel()
+	var verdict *scanner.Verdict
+	body, err := s.blobs.Get(ctx, attachment.Path)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		// Nothing is left to show.
+		verdict = &scanner.Verdict{Threat: "File Removed"}
+	case err != nil:
+		log.Printf("scan %s: %v", attachment.ID.Hex(), err)
+		return
+	default:
+		verdict, err = s.scanner.Scan(ctx, body)
+		body.Close()
+	}
+	if errors.Is(err, scanner.ErrTooLarge) {
+		// Nothing was found, so the file is not deleted, but nor can it be
+		// shown to anyone else.
+		attachment.Status = t.AttachmentUnscanned
+		if err := s.store.SetAttachmentStatus(attachment.ID, attachment.Status, ""); err != nil {
+			log.Printf("SetAttachmentStatus %s: %v", attachment.ID.Hex(), err)
+			return
+		}
+		s.emit([]primitive.ObjectID{message.From}, &t.Event{
+			Type: "attachment.unscanned",
+			Data: attachmentEvent{
+				ChatId:     message.ChatId,
+				MessageId:  message.ID,
+				Attachment: s.presentAttachment(message.From, message, *attachment),
+			},
+		})
+		return
+	}
+	if err != nil {
+		// The attachment stays pending and is picked up again by
+		// rescanPending.
+		log.Printf("scan %s: %v", attachment.ID.Hex(), err)
+		return
+	}
+
+	if verdict.Clean {
+		attachment.Status = t.AttachmentClean
+	} else {
+		attachment.Status = t.AttachmentBlocked
+		attachment.Threat = verdict.Threat
+	}
+	if err := s.store.SetAttachmentStatus(attachment.ID, attachment.Status, attachment.Threat); err != nil {
+		log.Printf("SetAttachmentStatus %s: %v", attachment.ID.Hex(), err)
+		return
+	}
+
+	if !verdict.Clean {
+		s.deleteAttachmentFiles(ctx, message, attachment)
+		s.emit([]primitive.ObjectID{message.From}, &t.Event{
+			Type: "attachment.blocked",
+			Data: attachmentEvent{
+				ChatId:     message.ChatId,
+				MessageId:  message.ID,
+				Attachment: attachment,
+			},
+		})
+		return
+	}
+	chat, err := s.store.FindChatById(message.ChatId)
+	if err != nil {
+		log.Printf("scan %s: %v", attachment.ID.Hex(), err)
+		return
+	}
+	for _, viewer := range chat.Participants {
+		s.emit([]primitive.ObjectID{viewer}, &t.Event{
+			Type: "attachment.ready",
+			Data: attachmentEvent{
+				ChatId:     message.ChatId,
+				MessageId:  message.ID,
+				Attachment: s.presentAttachment(viewer, message, *attachment),
+			},
+		})
+	}
+}
+
+// deleteAttachmentFiles drops a blocked file and its renditions from the
+// message and its forwarded copies. Other messages with the same bytes
+// keep the stored file until their own scan blocks it.
+func (s *Server) deleteAttachmentFiles(ctx context.Context, message *t.Message, attachment *t.Attachment) {
+	ids, err := s.store.FindMessageIdsByAttachment(attachment.ID)
+	if err != nil {
+		log.Printf("FindMessageIdsByAttachment %s: %v", attachment.ID.Hex(), err)
+		ids = []primitive.ObjectID{message.ID}
+	}
+	for _, id := range ids {
+		s.releaseBlobs(ctx, messageRef(id), attachmentPaths(*attachment)...)
+	}
+}
+
+// rescanPending retries scans that failed or were cut short by a restart.
+func (s *Server) rescanPending() {
+	ticker := time.NewTicker(scanRetryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		messages, err := s.store.FindPendingScans(time.Now().Add(-scanRetryInterval))
+		if err != nil {
+			log.Printf("FindPendingScans: %v", err)
+			continue
+		}
+		for i := range messages {
+			s.scanAttachments(&messages[i])
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/SourishBeast7/Glooo/scanner"
+	"github.com/SourishBeast7/Glooo/storage"
+	types "github.com/SourishBeast7/Glooo/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// flagEverything is a scanner that finds a threat in every file.
+type flagEverything struct{}
+
+func (flagEverything) Scan(ctx context.Context, r io.Reader) (*scanner.Verdict, error) {
+	return &scanner.Verdict{Threat: "Test.Threat"}, nil
+}
+
+// sendFile stores data as the attachment of a new message from user.
+func sendFile(t *testing.T, ts *testServer, chat *types.Chats, from *types.MongoUser, data []byte) *types.Message {
+	t.Helper()
+	msg := &types.Message{ID: primitive.NewObjectID(), From: from.ID, ChatId: chat.ID}
+	attachment, err := ts.storeAttachment(context.Background(), msg.ID, bytes.NewReader(data), "notes.txt", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Attachments = []types.Attachment{*attachment}
+	if _, err := ts.store.AddMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func blobExists(t *testing.T, ts *testServer, path string) bool {
+	t.Helper()
+	body, err := ts.blobs.Get(context.Background(), path)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	return true
+}
+
+func TestBlockedAttachmentKeepsSharedFile(t *testing.T) {
+	ts := newTestServer(t)
+	requireMongoDB(t, "arrayFilters")
+	alice := ts.addUser(t, "alice@example.com", "hunter22")
+	bob := ts.addUser(t, "bob@example.com", "hunter22")
+	chat := addChat(t, ts, alice, bob)
+	data := []byte("the same bytes sent twice")
+	first := sendFile(t, ts, chat, alice, data)
+	second := sendFile(t, ts, chat, bob, data)
+	path := first.Attachments[0].Path
+	if second.Attachments[0].Path != path {
+		t.Fatal("the same bytes were stored twice")
+	}
+
+	ts.scanner = flagEverything{}
+	ts.scanAttachment(first, &first.Attachments[0])
+	if first.Attachments[0].Status != types.AttachmentBlocked {
+		t.Fatalf("status %q after a threat was found", first.Attachments[0].Status)
+	}
+	if !blobExists(t, ts, path) {
+		t.Fatal("blocking one message deleted the file another message refers to")
+	}
+
+	ts.scanAttachment(second, &second.Attachments[0])
+	if blobExists(t, ts, path) {
+		t.Fatal("the file is still stored after every message with it was blocked")
+	}
+}
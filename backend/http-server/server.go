@@ -2,16 +2,24 @@ package httpserver
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"net/mail"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/SourishBeast7/Glooo/db"
 	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/SourishBeast7/Glooo/keys"
+	"github.com/SourishBeast7/Glooo/mailer"
+	"github.com/SourishBeast7/Glooo/media"
+	"github.com/SourishBeast7/Glooo/scanner"
+	"github.com/SourishBeast7/Glooo/storage"
 	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -21,9 +29,20 @@ import (
 
 type Server struct {
 	listenAddr string
-	conn       map[*websocket.Conn]bool
+	conn       map[primitive.ObjectID]map[*client]bool
 	mutex      sync.RWMutex
 	store      *db.Store
+	blobs      storage.BlobStore
+	signer     *urlSigner
+	scanner    scanner.Scanner
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	revoked    *revocationCache
+	keys       *keys.Keyset
+	mailer     mailer.Mailer
+	emailLocks userLocks
+	webauthn   *webauthn.WebAuthn
+	oidc       map[string]*oidcProvider
 }
 
 type handlerFunc func(w http.ResponseWriter, r *http.Request) error
@@ -39,11 +58,60 @@ var upgrader = websocket.Upgrader{
 }
 
 func NewServer(addr string) *Server {
+	blobs, err := storage.FromEnv()
+	if err != nil {
+		log.Fatalf("❌ Storage setup failed: %s", err.Error())
+	}
+	keyset, err := keys.FromEnv()
+	if err != nil {
+		log.Fatalf("❌ JWT key setup failed: %s", err.Error())
+	}
+	m.UseKeyset(keyset)
+	mail, err := mailer.FromEnv()
+	if err != nil {
+		log.Fatalf("❌ Mail setup failed: %s", err.Error())
+	}
+	passkeys, err := newWebAuthn()
+	if err != nil {
+		log.Fatalf("❌ Passkey setup failed: %s", err.Error())
+	}
+	store, err := db.ConnectMongo()
+	if err != nil {
+		log.Fatalf("❌ MongoDB setup failed: %s", err.Error())
+	}
+	revoked := newRevocationCache(store)
+	m.UseRevocationList(revoked)
+	activity := newActivityTracker(store)
+	m.UseActivityRecorder(activity)
 	return &Server{
 		listenAddr: addr,
-		conn:       make(map[*websocket.Conn]bool),
-		store:      db.ConnectMongo(),
+		conn:       make(map[primitive.ObjectID]map[*client]bool),
+		store:      store,
+		revoked:    revoked,
+		keys:       keyset,
+		mailer:     mail,
+		webauthn:   passkeys,
+		oidc:       loadOIDCProviders(),
+		blobs:      blobs,
+		signer:     newURLSigner(),
+		scanner:    scanner.FromEnv(),
+		accessTTL:  durationFromEnv("ACCESS_TOKEN_TTL", defaultAccessTokenTTL),
+		refreshTTL: durationFromEnv("REFRESH_TOKEN_TTL", defaultRefreshTokenTTL),
+	}
+}
+
+// durationFromEnv reads a duration such as "15m" from the environment.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("⚠️ Invalid %s %q, using %s", name, v, def)
+		return def
 	}
+	return d
 }
 
 func makeHttpHandler(f handlerFunc) http.HandlerFunc {
@@ -54,66 +122,87 @@ func makeHttpHandler(f handlerFunc) http.HandlerFunc {
 	}
 }
 
-func WriteJson(w http.ResponseWriter, status int, v map[string]any) error {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	return json.NewEncoder(w).Encode(v)
+// currentUserId returns the id of the user making the request, as
+// authenticated by AuthMiddleWare from the token's subject.
+func currentUserId(r *http.Request) (primitive.ObjectID, error) {
+	principal, ok := m.PrincipalFrom(r.Context())
+	if !ok {
+		return primitive.NilObjectID, errors.New("request is not authenticated")
+	}
+	return principal.UserId, nil
 }
 
-func uploadFilesToCdn(file io.Reader, email string, filename string) (string, error) {
-	var (
-		bunnyStorageZone = os.Getenv("BUNNYCDNSZONE")
-		bunnyStorageKey  = os.Getenv("BUNNYCDNPASS")
-		bunnyStorageHost = os.Getenv("BUNNYCDNHOST")
-	)
-	uploadURL := fmt.Sprintf("https://%s/%s/profilepictures/%s/%s", bunnyStorageHost, bunnyStorageZone, email, filename)
-
-	req, err := http.NewRequest(http.MethodPut, uploadURL, file)
+// chatForUser loads a chat and makes sure the given user takes part in it.
+func (s *Server) chatForUser(chatId string, userId primitive.ObjectID) (*t.Chats, error) {
+	id, err := primitive.ObjectIDFromHex(chatId)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	req.Header.Set("AccessKey", bunnyStorageKey)
-	req.Header.Set("Content-Type", "application/octet-stream")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	chat, err := s.store.FindChatById(id)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("upload failed: %s", string(body))
+	if !chat.HasParticipant(userId) {
+		return nil, fmt.Errorf("user %s is not a participant of chat %s", userId.Hex(), chatId)
 	}
-	return uploadURL, nil
+	return chat, nil
+}
+
+func WriteJson(w http.ResponseWriter, status int, v map[string]any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
 }
 
-func GenerateJWT(user *t.MongoUser) (string, error) {
-	claims := jwt.MapClaims{
-		"email":     user.Email,
-		"name":      user.Name,
-		"pfp":       user.Pfp,
-		"createdAt": user.CreatedAt,
+// GenerateJWT issues an access token for user in the login sessionId,
+// valid until the returned time.
+func (s *Server) GenerateJWT(user *t.MongoUser, sessionId primitive.ObjectID, ttl time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(ttl)
+	claims := m.Claims{
+		Email:      user.Email,
+		Name:       user.Name,
+		CreatedAt:  user.CreatedAt,
+		SessionId:  sessionId.Hex(),
+		Unverified: user.Unverified,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.ID.Hex(),
+			ID:        primitive.NewObjectID().Hex(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
 	}
-	jwtSecret := []byte(os.Getenv("JWT_SECRET"))
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString(jwtSecret)
+	signedToken, err := s.keys.Sign(claims)
 	if err != nil {
-		return "", err
+		return "", expires, err
 	}
 
-	return signedToken, nil
+	return signedToken, expires, nil
 }
 
 func (s *Server) HandleRoutes() {
+	handler := s.routes()
+	go s.expireUploads()
+	go s.rescanPending()
+	go s.pruneRevocations()
+	go s.keys.Watch(keyReloadInterval)
+	log.Printf("🚀 Server started on http://localhost%s", s.listenAddr)
+	http.ListenAndServe(s.listenAddr, handler)
+}
+
+// routes builds the handler for every route the server answers.
+func (s *Server) routes() http.Handler {
 	router := mux.NewRouter()
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:5173", "http:localhost:5173/*"},
 		AllowCredentials: true,
 		Debug:            true,
 		AllowedHeaders:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "HEAD", "DELETE", "OPTIONS"},
+		ExposedHeaders: []string{
+			"Location", "Upload-Offset", "Upload-Length", "Upload-Expires", "Upload-Message-Id",
+			"Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size",
+		},
 	})
 
 	handler := c.Handler(router)
@@ -121,14 +210,18 @@ func (s *Server) HandleRoutes() {
 	s.handleChatRoutes(router.PathPrefix("/chat").Subrouter())
 	s.handleApiRoutes(router.PathPrefix("/api").Subrouter())
 	s.handleTestingRoutes(router.PathPrefix("/test").Subrouter())
+	s.handleMediaRoutes(router.PathPrefix("/media").Subrouter())
+	s.handleKeyRoutes(router)
+	if files, ok := s.blobs.(http.Handler); ok {
+		router.PathPrefix("/files/").Handler(files)
+	}
 
 	router.HandleFunc("/", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
 		return WriteJson(w, http.StatusOK, Response{
 			"message": "Welcome",
 		})
 	}))
-	log.Printf("🚀 Server started on http://localhost%s", s.listenAddr)
-	http.ListenAndServe(s.listenAddr, handler)
+	return handler
 }
 
 func (s *Server) handleAuthRoutes(router *mux.Router) {
@@ -140,28 +233,57 @@ func (s *Server) handleAuthRoutes(router *mux.Router) {
 			return err
 		}
 		user.Name = r.FormValue("name")
-		user.Email = r.FormValue("email")
+		user.Email = db.NormalizeEmail(r.FormValue("email"))
 		user.Password = r.FormValue("password")
-		file, header, err := r.FormFile("pfp")
-		if err != nil {
-			return err
+		if addr, err := mail.ParseAddress(user.Email); err != nil || addr.Address != user.Email {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"message": "Invalid Email Address",
+			})
+		}
+		if user.Password == "" {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"message": "Missing Password",
+			})
 		}
 		if s.store.UserAlreadyExists(user.Email) {
 			return WriteJson(w, http.StatusNotAcceptable, Response{
 				"message": "User Already Exists",
 			})
 		}
-		defer file.Close()
-		pfp, err := uploadFilesToCdn(file, user.Email, header.Filename)
+		// The picture is optional; without one the user starts out with an
+		// identicon.
+		user.ID = primitive.NewObjectID()
+		var avatar *t.Avatar
+		file, _, err := r.FormFile("pfp")
+		switch {
+		case err == nil:
+			defer file.Close()
+			avatar, err = s.storeAvatar(r.Context(), userRef(user.ID), file)
+		case errors.Is(err, http.ErrMissingFile):
+			avatar, err = s.defaultAvatar(r.Context(), userRef(user.ID), userAvatarSeed(user))
+		}
+		if errors.Is(err, media.ErrNotImage) {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"message": "Profile Picture Must Be An Image",
+			})
+		}
 		if err != nil {
 			return err
 		}
-		user.Pfp = pfp
+		user.Pfp, user.PfpSizes = avatar.URL, avatar.Sizes
+		user.PfpGenerated, user.PfpPlaceholder = avatar.Generated, avatar.Placeholder
+		// Until the address is confirmed the account can log in but not
+		// reach anyone.
+		user.Unverified = true
 		res, err := s.store.AddUser(user)
 		if err != nil {
+			s.releaseBlobs(r.Context(), userRef(user.ID), variantPaths(user.PfpSizes)...)
 			WriteJson(w, http.StatusNotAcceptable, res)
 			return err
 		}
+		if err := s.sendVerification(r.Context(), user); err != nil {
+			log.Printf("sendVerification %s: %v", user.ID.Hex(), err)
+		}
 		return WriteJson(w, http.StatusOK, res)
 	})).Methods(http.MethodPost)
 
@@ -176,82 +298,96 @@ func (s *Server) handleAuthRoutes(router *mux.Router) {
 		if err != nil {
 			return err
 		}
-		token, err := GenerateJWT(user)
-		if err != nil {
+		if user.TwoFactorEnabled() {
+			return s.startChallenge(w, user, u.Device)
+		}
+		if err := s.startSession(w, r, user, u.Device); err != nil {
 			WriteJson(w, http.StatusNotAcceptable, Response{
 				"success": false,
 			})
 			return err
 		}
-		id := user.ID.Hex()
-		finalToken := fmt.Sprintf("Bearer %s", token)
-		http.SetCookie(w, &http.Cookie{
-			Name:     "token",
-			Value:    finalToken,
-			HttpOnly: true,
-			Path:     "/",
-			SameSite: http.SameSiteLaxMode,
-			Secure:   false, // Set to true in production with HTTPS
-		})
-		http.SetCookie(w, &http.Cookie{
-			Name:     "UID",
-			Value:    string(id),
-			HttpOnly: true,
-			Path:     "/",
-			SameSite: http.SameSiteLaxMode,
-			Secure:   false, // Set to true in production with HTTPS
-		})
 		return WriteJson(w, http.StatusOK, Response{
 			"success": true,
 		})
 	})).Methods(http.MethodPost)
+
+	s.handleChallengeRoutes(router)
+	s.handlePasskeyRoutes(router)
+	s.handleOIDCRoutes(router)
+	s.handleTokenRoutes(router)
+	s.handleVerificationRoutes(router)
+	s.handlePasswordRoutes(router)
+	s.handleLogoutRoutes(router)
 }
 
 func (s *Server) handleApiRoutes(router *mux.Router) {
-	router.HandleFunc("/getchats", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
-		userId, err := r.Cookie("UID")
+	router.HandleFunc("/user/me", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
 		if err != nil {
-			WriteJson(w, http.StatusNotAcceptable, Response{
-				"err": err,
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
+		user, err := s.store.FindUserById(userId)
+		if err != nil {
+			WriteJson(w, http.StatusNotFound, Response{
+				"err": "User Not Found",
 			})
 			return err
 		}
+		return WriteJson(w, http.StatusOK, Response{
+			"user": s.presentUser(user),
+		})
+	}))).Methods(http.MethodGet)
+
+	router.HandleFunc("/getchats", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
 
-		res, err := s.store.GetChatsByUserId(userId.Value)
+		res, err := s.store.GetChatsByUserId(userId.Hex())
 		if err != nil {
 			return err
 		}
+		for i := range res {
+			res[i] = *s.presentChat(&res[i])
+		}
 		return WriteJson(w, http.StatusOK, Response{
 			"data": res,
 		})
 	}))).Methods(http.MethodGet)
 
 	router.HandleFunc("/getmessages", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
-		chatid, err := r.Cookie("UID")
+		userId, err := currentUserId(r)
 		if err != nil {
-			WriteJson(w, http.StatusNotAcceptable, Response{
-				"err": err,
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
+		chat, err := s.chatForUser(r.URL.Query().Get("chatid"), userId)
+		if err != nil {
+			WriteJson(w, http.StatusForbidden, Response{
+				"err": "Chat Not Found",
 			})
 			return err
 		}
-		messages, ok := s.store.FindMessagesByChatId(chatid.Value)
+		messages, ok := s.store.FindMessagesByChatId(chat.ID.Hex())
 		return WriteJson(w, http.StatusOK, Response{
 			"success":  ok,
-			"messages": messages,
+			"messages": s.presentMessages(userId, messages),
 		})
 	})))
 
-	router.HandleFunc("/chat/create", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
-		userId, err := r.Cookie("UID")
+	router.HandleFunc("/chat/create", m.VerifiedMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		id, err := currentUserId(r)
 		if err != nil {
-			WriteJson(w, http.StatusNotAcceptable, Response{
+			return WriteJson(w, http.StatusUnauthorized, Response{
 				"err": err.Error(),
 			})
-			return err
-		}
-		id, err := primitive.ObjectIDFromHex(userId.Value)
-		if err != nil {
-			return err
 		}
 		user1, e := s.store.FindUserById(id)
 		if e != nil {
@@ -285,6 +421,101 @@ func (s *Server) handleApiRoutes(router *mux.Router) {
 		})
 
 	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/chat/group/create", m.VerifiedMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
+		data := struct {
+			Name   string   `json:"name"`
+			Emails []string `json:"emails"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": err.Error(),
+			})
+			return err
+		}
+		if data.Name == "" || len(data.Emails) == 0 {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "A Group Needs A Name And Members",
+			})
+		}
+		members := make([]primitive.ObjectID, 0, len(data.Emails))
+		for _, email := range data.Emails {
+			member, err := s.store.FindUserByEmail(email)
+			if err != nil {
+				WriteJson(w, http.StatusNotAcceptable, Response{
+					"err": err.Error(),
+				})
+				return err
+			}
+			members = append(members, member.ID)
+		}
+		res, success := s.store.CreateGroupChat(data.Name, userId, members...)
+		if !success {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"success": success,
+			})
+		}
+		avatar, err := s.defaultAvatar(r.Context(), chatRef(res), res.Hex())
+		if err == nil {
+			_, err = s.store.SetChatAvatar(res, avatar)
+		}
+		if err != nil {
+			log.Printf("avatar for group %s: %v", res.Hex(), err)
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"id": res,
+		})
+	}))).Methods(http.MethodPost)
+
+	router.HandleFunc("/chat/{chatid}/leave", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
+		chat, err := s.chatForUser(mux.Vars(r)["chatid"], userId)
+		if err != nil {
+			WriteJson(w, http.StatusForbidden, Response{
+				"err": "Chat Not Found",
+			})
+			return err
+		}
+		if !chat.Group {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Only Groups Can Be Left",
+			})
+		}
+		// Dropping the membership is also what revokes this user's media
+		// links for the chat: they are checked against it on every fetch.
+		if err := s.store.RemoveParticipant(chat.ID, userId); err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		s.emitToChat(chat, &t.Event{
+			Type: "chat.leave",
+			Data: Response{
+				"chatid": chat.ID,
+				"userId": userId,
+			},
+		})
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPost)
+
+	s.handleAvatarRoutes(router)
+	s.handleSessionRoutes(router)
+	s.handleTwoFactorRoutes(router)
+	s.handleMessageRoutes(router)
 }
 
 //WebSocket - Websocket routes
@@ -296,90 +527,9 @@ func (s *Server) handleChatRoutes(router *mux.Router) {
 			"chat id": userId,
 		})
 	}))).Methods("GET")
-	// router.HandleFunc("/", m.AuthMiddleWare(makeHttpHandler(s.wsConnHandler))).Methods(http.MethodGet)
+	router.HandleFunc("/", m.AuthMiddleWare(makeHttpHandler(s.wsConnHandler))).Methods(http.MethodGet)
 }
 
-// func (s *Server) wsConnHandler(w http.ResponseWriter, r *http.Request) error {
-// 	log.Println("➡️ Incoming WebSocket request...")
-// 	conn, err := upgrader.Upgrade(w, r, nil)
-// 	if err != nil {
-// 		log.Println("❌ WebSocket upgrade failed:", err)
-// 		return err
-// 	}
-
-// 	log.Println("✅ WebSocket connection upgraded")
-// 	userId, err := r.Cookie("UID")
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	s.mutex.Lock()
-// 	s.conn[conn] = true
-// 	s.mutex.Unlock()
-
-// 	go s.readLoop(conn, userId.Value)
-// 	return nil
-// }
-
-// func (s *Server) readLoop(con *websocket.Conn, userID string) {
-// 	defer func() {
-// 		s.mutex.Lock()
-// 		delete(s.conn, con)
-// 		s.mutex.Unlock()
-// 		con.Close()
-// 	}()
-// 	for {
-// 		var m map[string]string
-// 		err := con.ReadJSON(&m)
-// 		if err != nil {
-// 			log.Printf("%+v", err)
-// 			continue
-// 		}
-// 		from, err := primitive.ObjectIDFromHex(userID)
-// 		if err != nil {
-// 			log.Printf("%+v", err)
-// 			continue
-// 		}
-// 		to, err := s.store.FindUserByEmail(m["to"])
-// 		if err != nil {
-// 			log.Println(err.Error())
-// 			continue
-// 		}
-// 		message := new(t.Message)
-// 		message.Data = m["data"]
-// 		message.To = to.ID
-// 		message.From = from
-// 		id, ok := s.store.CreateChat(from, message.To)
-// 		if !ok {
-// 			log.Println("Chat Creation Failed")
-// 			continue
-// 		}
-// 		message.ChatId = id
-// 		message.ArrivalTime = time.Now().Format("2006-01-02 15:04:05")
-
-// 		res := s.store.AddMessages(message, id)
-// 		if !res {
-// 			log.Println("AddMessages Failed")
-// 			return
-// 		}
-// 		log.Printf("%v", message)
-// 	}
-// }
-
-// func (s *Server) broadcast(sender *websocket.Conn, messageType int, data []byte) error {
-// 	s.mutex.Lock()
-// 	defer s.mutex.Unlock()
-// 	for con, b := range s.conn {
-// 		if !b || con == sender {
-// 			continue
-// 		}
-// 		if err := con.WriteMessage(messageType, data); err != nil {
-// 			return err
-// 		}
-// 	}
-// 	return nil
-// }
-
 //Testing Routes Start
 
 func (s *Server) handleTestingRoutes(router *mux.Router) {
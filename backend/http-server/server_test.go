@@ -0,0 +1,259 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/SourishBeast7/Glooo/db"
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/SourishBeast7/Glooo/keys"
+	"github.com/SourishBeast7/Glooo/mailer"
+	"github.com/SourishBeast7/Glooo/scanner"
+	"github.com/SourishBeast7/Glooo/storage"
+	types "github.com/SourishBeast7/Glooo/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mailbox is a mailer that keeps every message instead of sending it.
+type mailbox struct {
+	mutex sync.Mutex
+	sent  []*mailer.Message
+}
+
+func (b *mailbox) Send(ctx context.Context, msg *mailer.Message) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.sent = append(b.sent, msg)
+	return nil
+}
+
+// to returns the messages sent to addr, oldest first.
+func (b *mailbox) to(addr string) []*mailer.Message {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var out []*mailer.Message
+	for _, msg := range b.sent {
+		if msg.To == addr {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+var linkToken = regexp.MustCompile(`[?&]token=([A-Za-z0-9_-]+)`)
+
+// tokenIn returns the token of the link in msg.
+func tokenIn(t *testing.T, msg *mailer.Message) string {
+	t.Helper()
+	match := linkToken.FindStringSubmatch(msg.Text)
+	if match == nil {
+		t.Fatalf("no link with a token in %q", msg.Text)
+	}
+	return match[1]
+}
+
+type testServer struct {
+	*Server
+	URL  string
+	mail *mailbox
+}
+
+// newTestServer serves every route against a throwaway database. Tests
+// using it are skipped unless MONGO_TEST_URI points at a MongoDB server;
+// CI sets it, and README.md shows how to run them locally.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI not set")
+	}
+	store, err := db.Connect(uri, "glooo_test_"+primitive.NewObjectID().Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DropDatabase() })
+	blobs, err := storage.NewLocalStore(t.TempDir(), "", []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyset, err := keys.Load("", []byte("test secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	passkeys, err := newWebAuthn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := newRevocationCache(store)
+	m.UseKeyset(keyset)
+	m.UseRevocationList(revoked)
+	m.UseActivityRecorder(nil)
+
+	box := new(mailbox)
+	s := &Server{
+		conn:       make(map[primitive.ObjectID]map[*client]bool),
+		store:      store,
+		revoked:    revoked,
+		keys:       keyset,
+		mailer:     box,
+		webauthn:   passkeys,
+		oidc:       make(map[string]*oidcProvider),
+		blobs:      blobs,
+		signer:     newURLSigner(),
+		scanner:    scanner.Nop{},
+		accessTTL:  defaultAccessTokenTTL,
+		refreshTTL: defaultRefreshTokenTTL,
+	}
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+	return &testServer{Server: s, URL: ts.URL, mail: box}
+}
+
+// requireMongoDB skips the rest of a test that relies on MongoDB
+// behaviour FerretDB lacks, when the tests run against FerretDB.
+func requireMongoDB(t *testing.T, missing string) {
+	t.Helper()
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(os.Getenv("MONGO_TEST_URI")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+	var info bson.M
+	if err := client.Database("admin").RunCommand(context.Background(), bson.M{"buildInfo": 1}).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := info["ferretdbVersion"]; ok {
+		t.Skip("FerretDB lacks " + missing)
+	}
+}
+
+// addUser stores a verified user with the given password.
+func (ts *testServer) addUser(t *testing.T, email, password string) *types.MongoUser {
+	t.Helper()
+	user := &types.MongoUser{
+		ID:       primitive.NewObjectID(),
+		Name:     "Test User",
+		Email:    email,
+		Password: password,
+	}
+	if _, err := ts.store.AddUser(user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// client returns an HTTP client keeping its own cookies, like a browser.
+func (ts *testServer) client(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// login signs in with a password and returns the logged in client.
+func (ts *testServer) login(t *testing.T, email, password string) *http.Client {
+	t.Helper()
+	c := ts.client(t)
+	res, body := ts.do(t, c, http.MethodPost, "/auth/login", Response{
+		"email":    email,
+		"password": password,
+	})
+	if res.StatusCode != http.StatusOK || body["success"] != true {
+		t.Fatalf("login as %s: %d %v", email, res.StatusCode, body)
+	}
+	return c
+}
+
+// do sends body as JSON and decodes the JSON answer, if any.
+func (ts *testServer) do(t *testing.T, c *http.Client, method, path string, body any) (*http.Response, Response) {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return ts.send(t, c, req)
+}
+
+// postForm sends fields as a multipart form.
+func (ts *testServer) postForm(t *testing.T, c *http.Client, path string, fields map[string]string) (*http.Response, Response) {
+	t.Helper()
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		form.WriteField(k, v)
+	}
+	form.Close()
+	req, err := http.NewRequest(http.MethodPost, ts.URL+path, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return ts.send(t, c, req)
+}
+
+func (ts *testServer) send(t *testing.T, c *http.Client, req *http.Request) (*http.Response, Response) {
+	t.Helper()
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := Response{}
+	if len(data) > 0 && res.Header.Get("Content-Type") == "application/json" {
+		if err := json.Unmarshal(data, &out); err != nil {
+			t.Fatalf("%s %s: %v in %q", req.Method, req.URL.Path, err, data)
+		}
+	}
+	return res, out
+}
+
+// cookie returns the value of the cookie c would send to path.
+func (ts *testServer) cookie(t *testing.T, c *http.Client, path, name string) string {
+	t.Helper()
+	u, err := url.Parse(ts.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range c.Jar.Cookies(u) {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,158 @@
+package httpserver
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/db"
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Activity is written at most this often per session.
+const activityInterval = time.Minute
+
+// activityTracker keeps the last activity of sessions up to date without
+// writing on every request.
+type activityTracker struct {
+	store *db.Store
+	mutex sync.Mutex
+	seen  map[primitive.ObjectID]time.Time
+}
+
+func newActivityTracker(store *db.Store) *activityTracker {
+	return &activityTracker{
+		store: store,
+		seen:  make(map[primitive.ObjectID]time.Time),
+	}
+}
+
+func (a *activityTracker) Active(principal *m.Principal, r *http.Request) {
+	now := time.Now()
+	a.mutex.Lock()
+	if now.Sub(a.seen[principal.SessionId]) < activityInterval {
+		a.mutex.Unlock()
+		return
+	}
+	a.seen[principal.SessionId] = now
+	for id, at := range a.seen {
+		if now.Sub(at) >= activityInterval {
+			delete(a.seen, id)
+		}
+	}
+	a.mutex.Unlock()
+	ip := clientIP(r)
+	go func() {
+		if err := a.store.TouchSession(principal.SessionId, ip, now); err != nil {
+			log.Printf("TouchSession %s: %v", principal.SessionId.Hex(), err)
+		}
+	}()
+}
+
+// clientIP returns the address a request came from.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// describeDevice names a device after its user agent, e.g. "Firefox on
+// Linux".
+func describeDevice(userAgent string) string {
+	browsers := []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	}
+	systems := []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	}
+	browser, system := "", ""
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, s := range systems {
+		if strings.Contains(userAgent, s.token) {
+			system = s.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	default:
+		return "Unknown Device"
+	}
+}
+
+func (s *Server) handleSessionRoutes(router *mux.Router) {
+	router.HandleFunc("/sessions", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		principal, _ := m.PrincipalFrom(r.Context())
+		sessions, err := s.store.FindSessions(principal.UserId)
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == principal.SessionId
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success":  true,
+			"sessions": sessions,
+		})
+	}))).Methods(http.MethodGet)
+
+	// Revoking a session logs that device out at once, both its REST
+	// requests and its websockets.
+	router.HandleFunc("/sessions/{sessionid}", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		principal, _ := m.PrincipalFrom(r.Context())
+		id, err := primitive.ObjectIDFromHex(mux.Vars(r)["sessionid"])
+		if err != nil {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": err.Error(),
+			})
+		}
+		session, err := s.store.FindSession(id)
+		if err != nil || session.UserId != principal.UserId {
+			return WriteJson(w, http.StatusNotFound, Response{
+				"err": "Session Not Found",
+			})
+		}
+		if err := s.revokeSessions(principal.UserId, session.ID); err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		if session.ID == principal.SessionId {
+			clearAuthCookies(w)
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodDelete)
+}
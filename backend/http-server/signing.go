@@ -0,0 +1,213 @@
+package httpserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const defaultMediaURLTTL = 15 * time.Minute
+
+// urlSigner issues and checks the short lived links under /media that let
+// clients fetch private files without sending their cookies.
+type urlSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+// newURLSigner reads MEDIA_SIGNING_KEY and MEDIA_URL_TTL. Without a key a
+// random one is used, so links stop working when the server restarts.
+func newURLSigner() *urlSigner {
+	key := []byte(os.Getenv("MEDIA_SIGNING_KEY"))
+	if len(key) == 0 {
+		log.Println("⚠️ MEDIA_SIGNING_KEY not set, media links will not survive a restart")
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &urlSigner{key: key, ttl: durationFromEnv("MEDIA_URL_TTL", defaultMediaURLTTL)}
+}
+
+func (u *urlSigner) mac(resource, viewer, expires string) string {
+	mac := hmac.New(sha256.New, u.key)
+	fmt.Fprintf(mac, "%s\n%s\n%s", resource, viewer, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sign returns a link to resource, usable by viewer until the TTL runs out.
+// The viewer is the nil id for links that anyone may follow.
+func (u *urlSigner) sign(resource string, viewer primitive.ObjectID, query url.Values) string {
+	if query == nil {
+		query = url.Values{}
+	}
+	expires := strconv.FormatInt(time.Now().Add(u.ttl).Unix(), 10)
+	query.Set("exp", expires)
+	if !viewer.IsZero() {
+		query.Set("uid", viewer.Hex())
+	}
+	query.Set("sig", u.mac(resource+"?"+query.Get("variant"), query.Get("uid"), expires))
+	return "/media/" + resource + "?" + query.Encode()
+}
+
+// verify checks the signature and expiry of a request for resource and
+// returns the viewer it was issued to.
+func (u *urlSigner) verify(resource string, query url.Values) (primitive.ObjectID, bool) {
+	viewer := primitive.NilObjectID
+	expires := query.Get("exp")
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return viewer, false
+	}
+	want := u.mac(resource+"?"+query.Get("variant"), query.Get("uid"), expires)
+	if !hmac.Equal([]byte(want), []byte(query.Get("sig"))) {
+		return viewer, false
+	}
+	if uid := query.Get("uid"); uid != "" {
+		if viewer, err = primitive.ObjectIDFromHex(uid); err != nil {
+			return viewer, false
+		}
+	}
+	return viewer, true
+}
+
+func attachmentResource(chatId, attachmentId primitive.ObjectID) string {
+	return fmt.Sprintf("chats/%s/%s", chatId.Hex(), attachmentId.Hex())
+}
+
+// presentMessage returns a copy of message whose attachment links are
+// signed for viewer. Attachments that have not passed their scan are only
+// linked for the sender.
+func (s *Server) presentMessage(viewer primitive.ObjectID, message *t.Message) *t.Message {
+	out := *message
+	out.Attachments = make([]t.Attachment, len(message.Attachments))
+	for i, a := range message.Attachments {
+		out.Attachments[i] = *s.presentAttachment(viewer, message, a)
+	}
+	if out.Content != nil && out.Content.Media != nil && out.Content.Media.AttachmentId != nil {
+		content := *out.Content
+		media := *content.Media
+		media.URL = ""
+		if a := message.AttachmentById(*media.AttachmentId); a == nil || visibleTo(viewer, message, a) {
+			media.URL = s.signer.sign(attachmentResource(message.ChatId, *media.AttachmentId), viewer, nil)
+		}
+		content.Media = &media
+		out.Content = &content
+	}
+	return &out
+}
+
+func visibleTo(viewer primitive.ObjectID, message *t.Message, a *t.Attachment) bool {
+	if a.Status == t.AttachmentBlocked {
+		return false
+	}
+	return a.Available() || viewer == message.From
+}
+
+func (s *Server) presentAttachment(viewer primitive.ObjectID, message *t.Message, a t.Attachment) *t.Attachment {
+	if !visibleTo(viewer, message, &a) {
+		a.URL = ""
+		a.Variants = nil
+		if viewer != message.From {
+			a.Threat = ""
+		}
+		return &a
+	}
+	resource := attachmentResource(message.ChatId, a.ID)
+	variants := a.Variants
+	a.URL = s.signer.sign(resource, viewer, nil)
+	a.Variants = make([]t.ImageVariant, len(variants))
+	for j, v := range variants {
+		v.URL = s.signer.sign(resource, viewer, url.Values{"variant": {v.Name}})
+		a.Variants[j] = v
+	}
+	return &a
+}
+
+func (s *Server) presentMessages(viewer primitive.ObjectID, messages []t.Message) []t.Message {
+	out := make([]t.Message, len(messages))
+	for i := range messages {
+		out[i] = *s.presentMessage(viewer, &messages[i])
+	}
+	return out
+}
+
+// presentUser replaces the stored avatar locations with signed links.
+// Avatars are not tied to a chat, so the links work for any viewer.
+func (s *Server) presentUser(user *t.MongoUser) *t.MongoUser {
+	out := *user
+	out.PfpSizes = make([]t.ImageVariant, len(user.PfpSizes))
+	for i, v := range user.PfpSizes {
+		v.URL = s.signer.sign(v.Path, primitive.NilObjectID, nil)
+		out.PfpSizes[i] = v
+	}
+	if len(out.PfpSizes) > 0 {
+		out.Pfp = out.PfpSizes[0].URL
+	}
+	return &out
+}
+
+// presentChat signs the avatar links of a group the same way as presentUser.
+func (s *Server) presentChat(chat *t.Chats) *t.Chats {
+	out := *chat
+	out.AvatarSizes = make([]t.ImageVariant, len(chat.AvatarSizes))
+	for i, v := range chat.AvatarSizes {
+		v.URL = s.signer.sign(v.Path, primitive.NilObjectID, nil)
+		out.AvatarSizes[i] = v
+	}
+	if len(out.AvatarSizes) > 0 {
+		out.Avatar = out.AvatarSizes[0].URL
+	}
+	return &out
+}
+
+// handleMediaRoutes serves files behind signed links. Attachment links are
+// bound to a viewer and stop working as soon as they leave the chat, even
+// before they expire.
+func (s *Server) handleMediaRoutes(router *mux.Router) {
+	router.HandleFunc("/chats/{chatid}/{attid}", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		vars := mux.Vars(r)
+		viewer, ok := s.signer.verify("chats/"+vars["chatid"]+"/"+vars["attid"], r.URL.Query())
+		if !ok || viewer.IsZero() {
+			return WriteJson(w, http.StatusForbidden, Response{
+				"err": "Invalid Or Expired Link",
+			})
+		}
+		return s.serveChatAttachment(w, r, viewer, vars["chatid"], vars["attid"])
+	})).Methods(http.MethodGet)
+
+	router.HandleFunc("/avatars/{name}", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		path := "avatars/" + mux.Vars(r)["name"]
+		if _, ok := s.signer.verify(path, r.URL.Query()); !ok {
+			return WriteJson(w, http.StatusForbidden, Response{
+				"err": "Invalid Or Expired Link",
+			})
+		}
+		body, err := s.blobs.Get(r.Context(), path)
+		if err != nil {
+			WriteJson(w, http.StatusNotFound, Response{
+				"err": "Avatar Not Found",
+			})
+			return err
+		}
+		defer body.Close()
+		name := filepath.Base(path)
+		serveAttachment(w, &t.Attachment{
+			Name: name,
+			Mime: mime.TypeByExtension(filepath.Ext(name)),
+		}, body)
+		return nil
+	})).Methods(http.MethodGet)
+}
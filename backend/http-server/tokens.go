@@ -0,0 +1,191 @@
+package httpserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+	refreshCookie          = "refresh_token"
+)
+
+// errSessionEnded is returned by issueTokens when the login was revoked
+// while its tokens were being renewed.
+var errSessionEnded = errors.New("session ended")
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSession logs user in: a session is recorded for the device and its
+// first access and refresh tokens are set as cookies.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, user *t.MongoUser, device string) error {
+	now := time.Now()
+	userAgent := r.UserAgent()
+	if device == "" {
+		device = describeDevice(userAgent)
+	}
+	session := &t.Session{
+		ID:         primitive.NewObjectID(),
+		UserId:     user.ID,
+		Device:     device,
+		UserAgent:  userAgent,
+		IP:         clientIP(r),
+		CreatedAt:  now,
+		LastActive: now,
+		ExpiresAt:  now.Add(s.refreshTTL),
+	}
+	if err := s.store.AddSession(session); err != nil {
+		return err
+	}
+	return s.issueTokens(w, user, session.ID)
+}
+
+// issueTokens sets a fresh access token and the next refresh token of
+// family.
+func (s *Server) issueTokens(w http.ResponseWriter, user *t.MongoUser, family primitive.ObjectID) error {
+	access, accessExpires, err := s.GenerateJWT(user, family, s.accessTTL)
+	if err != nil {
+		return err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	refresh := base64.RawURLEncoding.EncodeToString(secret)
+	now := time.Now()
+	if err := s.store.AddRefreshToken(&t.RefreshToken{
+		UserId:    user.ID,
+		Family:    family,
+		Hash:      hashToken(refresh),
+		ExpiresAt: now.Add(s.refreshTTL),
+		CreatedAt: now,
+	}); err != nil {
+		return err
+	}
+	// A revocation that ran after the old token was used has already
+	// revoked the family, but may have missed the token just added.
+	revoked, err := s.store.FindRevokedSession(family)
+	if err != nil {
+		return err
+	}
+	if revoked != nil {
+		if err := s.store.RevokeTokenFamily(family); err != nil {
+			return err
+		}
+		return errSessionEnded
+	}
+	if err := s.store.ExtendSession(family, now.Add(s.refreshTTL)); err != nil {
+		log.Printf("ExtendSession %s: %v", family.Hex(), err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    fmt.Sprintf("Bearer %s", access),
+		Expires:  accessExpires,
+		HttpOnly: true,
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+		Secure:   false, // Set to true in production with HTTPS
+	})
+	// The refresh token is only ever sent back to /auth.
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    refresh,
+		Expires:  now.Add(s.refreshTTL),
+		HttpOnly: true,
+		Path:     "/auth",
+		SameSite: http.SameSiteStrictMode,
+		Secure:   false, // Set to true in production with HTTPS
+	})
+	// Identity comes from the token alone; drop the UID cookie older
+	// logins left behind.
+	http.SetCookie(w, &http.Cookie{
+		Name:   "UID",
+		Path:   "/",
+		MaxAge: -1,
+	})
+	return nil
+}
+
+func clearAuthCookies(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: "token", Path: "/", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: refreshCookie, Path: "/auth", MaxAge: -1})
+}
+
+func (s *Server) handleTokenRoutes(router *mux.Router) {
+	// Each refresh token can be exchanged once. Seeing one again means it
+	// was copied, so the whole login it belongs to is revoked.
+	router.HandleFunc("/refresh", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		cookie, err := r.Cookie(refreshCookie)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": "Missing Refresh Token",
+			})
+		}
+		stored, err := s.store.FindRefreshToken(hashToken(cookie.Value))
+		if err != nil || stored.Revoked || time.Now().After(stored.ExpiresAt) {
+			clearAuthCookies(w)
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": "Invalid Refresh Token",
+			})
+		}
+		fresh, err := s.store.UseRefreshToken(stored.ID)
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		if !fresh {
+			log.Printf("refresh token reused in family %s, revoking it", stored.Family.Hex())
+			// Whoever holds the copy may already have access tokens and a
+			// websocket of the login, so all of it ends.
+			if err := s.revokeSessions(stored.UserId, stored.Family); err != nil {
+				WriteJson(w, http.StatusInternalServerError, Response{
+					"success": false,
+				})
+				return err
+			}
+			clearAuthCookies(w)
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": "Refresh Token Reused",
+			})
+		}
+		user, err := s.store.FindUserById(stored.UserId)
+		if err != nil {
+			clearAuthCookies(w)
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": "Invalid Refresh Token",
+			})
+		}
+		if err := s.issueTokens(w, user, stored.Family); errors.Is(err, errSessionEnded) {
+			clearAuthCookies(w)
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": "Session Ended",
+			})
+		} else if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	})).Methods(http.MethodPost)
+}
@@ -0,0 +1,57 @@
+package httpserver
+
+import (
+	"net/http"
+	"testing"
+)
+
+// refreshWith exchanges a refresh token for new tokens.
+func (ts *testServer) refreshWith(t *testing.T, c *http.Client, token string) (*http.Response, Response) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/auth/refresh", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: refreshCookie, Value: token})
+	return ts.send(t, c, req)
+}
+
+func TestRefreshTokenReuseEndsSession(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, "alice@example.com", "hunter22")
+	victim := ts.login(t, "alice@example.com", "hunter22")
+	other := ts.login(t, "alice@example.com", "hunter22")
+	stolen := ts.cookie(t, victim, "/auth", refreshCookie)
+
+	// The thief refreshes first and gets a working login of their own.
+	thief := ts.client(t)
+	res, body := ts.refreshWith(t, thief, stolen)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("refresh with the copied token: %d %v", res.StatusCode, body)
+	}
+	res, _ = ts.do(t, thief, http.MethodGet, "/api/user/me", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("thief's access token: %d", res.StatusCode)
+	}
+
+	// The victim's refresh then shows the token was used twice.
+	res, body = ts.refreshWith(t, ts.client(t), stolen)
+	if res.StatusCode != http.StatusUnauthorized || body["err"] != "Refresh Token Reused" {
+		t.Fatalf("reused refresh token: %d %v", res.StatusCode, body)
+	}
+	res, _ = ts.do(t, thief, http.MethodGet, "/api/user/me", nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("thief's access token still works after the reuse: %d", res.StatusCode)
+	}
+	res, _ = ts.refreshWith(t, thief, ts.cookie(t, thief, "/auth", refreshCookie))
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("thief's refresh token still works after the reuse: %d", res.StatusCode)
+	}
+
+	// Only the other login is left.
+	res, body = ts.do(t, other, http.MethodGet, "/api/sessions", nil)
+	sessions, _ := body["sessions"].([]any)
+	if res.StatusCode != http.StatusOK || len(sessions) != 1 {
+		t.Fatalf("sessions after the reuse: %d %v", res.StatusCode, body)
+	}
+}
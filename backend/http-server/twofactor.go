@@ -0,0 +1,375 @@
+package httpserver
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/SourishBeast7/Glooo/totp"
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/gorilla/mux"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	totpIssuer = "Glooo"
+	qrSize     = 256
+
+	recoveryCodeCount = 10
+	// recoveryCodeBytes is the randomness of a recovery code: 80 bits,
+	// shown as sixteen base32 characters.
+	recoveryCodeBytes = 10
+	// A login waiting for its second factor lasts challengeTTL and allows
+	// maxChallengeAttempts codes, right or wrong.
+	challengeTTL         = 5 * time.Minute
+	maxChallengeAttempts = 5
+)
+
+type secondFactor struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// newRecoveryCodes returns fresh recovery codes, formatted for the user,
+// and their hashes for the store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode ignores case, dashes and spaces so codes can be typed
+// as they are read.
+func hashRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return hashToken(code)
+}
+
+// checkSecondFactor accepts a current authenticator code or an unused
+// recovery code of user. Each works once.
+func (s *Server) checkSecondFactor(user *t.MongoUser, factor *secondFactor) (bool, error) {
+	if !user.TwoFactorEnabled() {
+		return false, errors.New("two factor authentication is off")
+	}
+	switch {
+	case factor.Code != "":
+		step, ok := totp.Validate(user.TwoFactor.Secret, factor.Code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		return s.store.UseTOTPStep(user.ID, step)
+	case factor.RecoveryCode != "":
+		return s.store.UseRecoveryCode(user.ID, hashRecoveryCode(factor.RecoveryCode))
+	default:
+		return false, nil
+	}
+}
+
+// stepUp is sent with requests that change how an account logs in, to
+// show they come from its owner and not just from a stolen session.
+type stepUp struct {
+	Password string `json:"password"`
+	secondFactor
+}
+
+// confirmStepUp checks the password of user and, when two factor
+// authentication is on, a second factor. Accounts made through a login
+// provider may have no password; the second factor is all they can
+// bring. On failure the response is already written.
+func (s *Server) confirmStepUp(w http.ResponseWriter, user *t.MongoUser, body *stepUp) error {
+	if user.Password != "" {
+		if _, err := s.store.AuthenticateUser(user.Email, body.Password); err != nil {
+			WriteJson(w, http.StatusUnauthorized, Response{
+				"err": "Wrong Password",
+			})
+			return err
+		}
+	}
+	if !user.TwoFactorEnabled() {
+		return nil
+	}
+	ok, err := s.checkSecondFactor(user, &body.secondFactor)
+	if err != nil {
+		WriteJson(w, http.StatusInternalServerError, Response{
+			"success": false,
+		})
+		return err
+	}
+	if !ok {
+		WriteJson(w, http.StatusUnauthorized, Response{
+			"err": "Invalid Code",
+		})
+		return fmt.Errorf("wrong second factor for %s", user.ID.Hex())
+	}
+	return nil
+}
+
+// newChallenge holds back the login of a user with two factor
+// authentication on. The session only starts once /auth/login/2fa gets a
+// code for the returned challenge.
+func (s *Server) newChallenge(user *t.MongoUser, device string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	err := s.store.AddLoginChallenge(&t.LoginChallenge{
+		UserId:    user.ID,
+		Hash:      hashToken(token),
+		Device:    device,
+		ExpiresAt: time.Now().Add(challengeTTL),
+	})
+	return token, err
+}
+
+// startChallenge answers a correct password with a challenge.
+func (s *Server) startChallenge(w http.ResponseWriter, user *t.MongoUser, device string) error {
+	token, err := s.newChallenge(user, device)
+	if err != nil {
+		WriteJson(w, http.StatusInternalServerError, Response{
+			"success": false,
+		})
+		return err
+	}
+	return WriteJson(w, http.StatusOK, Response{
+		"success":   false,
+		"twoFactor": true,
+		"challenge": token,
+	})
+}
+
+func (s *Server) handleChallengeRoutes(router *mux.Router) {
+	router.HandleFunc("/login/2fa", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		body := new(struct {
+			Challenge string `json:"challenge"`
+			secondFactor
+		})
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil || body.Challenge == "" {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Missing Challenge",
+			})
+		}
+		// The attempt is counted whether or not the code turns out right.
+		challenge, err := s.store.AttemptLoginChallenge(hashToken(body.Challenge), maxChallengeAttempts)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": "Invalid Or Expired Challenge",
+			})
+		}
+		user, err := s.store.FindUserById(challenge.UserId)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": "Invalid Or Expired Challenge",
+			})
+		}
+		ok, err := s.checkSecondFactor(user, &body.secondFactor)
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		if !ok {
+			if challenge.Attempts >= maxChallengeAttempts {
+				if _, err := s.store.DeleteLoginChallenge(challenge.ID); err != nil {
+					log.Printf("DeleteLoginChallenge %s: %v", challenge.ID.Hex(), err)
+				}
+				return WriteJson(w, http.StatusUnauthorized, Response{
+					"err": "Too Many Attempts, Log In Again",
+				})
+			}
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": "Invalid Code",
+			})
+		}
+		if ok, err := s.store.DeleteLoginChallenge(challenge.ID); err != nil || !ok {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": "Invalid Or Expired Challenge",
+			})
+		}
+		if err := s.startSession(w, r, user, challenge.Device); err != nil {
+			WriteJson(w, http.StatusNotAcceptable, Response{
+				"success": false,
+			})
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	})).Methods(http.MethodPost)
+}
+
+func (s *Server) handleTwoFactorRoutes(router *mux.Router) {
+	// Setting up returns the secret to scan; two factor authentication
+	// only turns on once /2fa/totp/enable sees a code made from it. Both
+	// take the password, like turning it off.
+	router.HandleFunc("/2fa/totp/setup", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		user, err := s.twoFactorUser(w, r)
+		if err != nil {
+			return err
+		}
+		body := new(stepUp)
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": err.Error(),
+			})
+		}
+		if user.TwoFactorEnabled() {
+			return WriteJson(w, http.StatusConflict, Response{
+				"err": "Two Factor Authentication Is Already On",
+			})
+		}
+		if err := s.confirmStepUp(w, user, body); err != nil {
+			return err
+		}
+		secret, err := totp.GenerateSecret()
+		if err == nil {
+			err = s.store.SetPendingTOTP(user.ID, secret)
+		}
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		uri := totp.URI(totpIssuer, user.Email, secret)
+		qr, err := qrcode.Encode(uri, qrcode.Medium, qrSize)
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+			"secret":  secret,
+			"uri":     uri,
+			"qr":      "data:image/png;base64," + base64.StdEncoding.EncodeToString(qr),
+		})
+	}))).Methods(http.MethodPost)
+
+	// The recovery codes are shown this once.
+	router.HandleFunc("/2fa/totp/enable", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		user, err := s.twoFactorUser(w, r)
+		if err != nil {
+			return err
+		}
+		// The code is from the authenticator being set up, not a second
+		// factor of the step-up: two factor authentication is still off.
+		body := new(stepUp)
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil || body.Code == "" {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Missing Code",
+			})
+		}
+		if user.TwoFactorEnabled() {
+			return WriteJson(w, http.StatusConflict, Response{
+				"err": "Two Factor Authentication Is Already On",
+			})
+		}
+		if user.TwoFactor == nil || user.TwoFactor.Pending == "" {
+			return WriteJson(w, http.StatusConflict, Response{
+				"err": "Set Up Two Factor Authentication First",
+			})
+		}
+		if err := s.confirmStepUp(w, user, body); err != nil {
+			return err
+		}
+		secret := user.TwoFactor.Pending
+		step, ok := totp.Validate(secret, body.Code, time.Now())
+		if !ok {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Invalid Code",
+			})
+		}
+		codes, hashes, err := newRecoveryCodes()
+		if err == nil {
+			ok, err = s.store.EnableTOTP(user.ID, secret, step, hashes)
+		}
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		if !ok {
+			return WriteJson(w, http.StatusConflict, Response{
+				"err": "Set Up Two Factor Authentication First",
+			})
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success":       true,
+			"recoveryCodes": codes,
+		})
+	}))).Methods(http.MethodPost)
+
+	// Turning it off takes the password and a second factor again, so a
+	// stolen session alone cannot.
+	router.HandleFunc("/2fa/totp/disable", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		user, err := s.twoFactorUser(w, r)
+		if err != nil {
+			return err
+		}
+		body := new(stepUp)
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": err.Error(),
+			})
+		}
+		if !user.TwoFactorEnabled() {
+			return WriteJson(w, http.StatusConflict, Response{
+				"err": "Two Factor Authentication Is Off",
+			})
+		}
+		if err := s.confirmStepUp(w, user, body); err != nil {
+			return err
+		}
+		if err := s.store.DisableTOTP(user.ID); err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPost)
+}
+
+// twoFactorUser loads the user making the request. On failure the response
+// is already written.
+func (s *Server) twoFactorUser(w http.ResponseWriter, r *http.Request) (*t.MongoUser, error) {
+	userId, err := currentUserId(r)
+	if err != nil {
+		WriteJson(w, http.StatusUnauthorized, Response{
+			"err": err.Error(),
+		})
+		return nil, err
+	}
+	user, err := s.store.FindUserById(userId)
+	if err != nil {
+		WriteJson(w, http.StatusNotFound, Response{
+			"err": "User Not Found",
+		})
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,250 @@
+package httpserver
+
+import (
+	"encoding/base32"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SourishBeast7/Glooo/totp"
+	types "github.com/SourishBeast7/Glooo/types"
+)
+
+// enableTOTP turns two factor authentication on for user and returns the
+// secret, with recoveryCode as its only recovery code.
+func enableTOTP(t *testing.T, ts *testServer, user *types.MongoUser, recoveryCode string) string {
+	t.Helper()
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.store.SetPendingTOTP(user.ID, secret); err != nil {
+		t.Fatal(err)
+	}
+	// A step from before any code the test makes, so none is a replay.
+	step := totp.Step(time.Now()) - 10
+	ok, err := ts.store.EnableTOTP(user.ID, secret, step, []string{hashRecoveryCode(recoveryCode)})
+	if err != nil || !ok {
+		t.Fatalf("EnableTOTP: %v", err)
+	}
+	return secret
+}
+
+func currentCode(t *testing.T, secret string) string {
+	t.Helper()
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// wrongCode is a valid looking code that does not match secret now.
+func wrongCode(t *testing.T, secret string) string {
+	t.Helper()
+	for _, code := range []string{"000000", "111111", "222222"} {
+		if _, ok := totp.Validate(secret, code, time.Now()); !ok {
+			return code
+		}
+	}
+	t.Fatal("every made up code is valid")
+	return ""
+}
+
+// challengeFor logs in with a password and returns the 2FA challenge.
+func challengeFor(t *testing.T, ts *testServer, email, password string) string {
+	t.Helper()
+	res, body := ts.do(t, ts.client(t), http.MethodPost, "/auth/login", Response{
+		"email":    email,
+		"password": password,
+	})
+	challenge, _ := body["challenge"].(string)
+	if res.StatusCode != http.StatusOK || body["twoFactor"] != true || challenge == "" {
+		t.Fatalf("login with 2FA on: %d %v", res.StatusCode, body)
+	}
+	return challenge
+}
+
+func TestLoginChallenge(t *testing.T) {
+	ts := newTestServer(t)
+	user := ts.addUser(t, "alice@example.com", "hunter22")
+	secret := enableTOTP(t, ts, user, "recovery-one")
+	challenge := challengeFor(t, ts, "alice@example.com", "hunter22")
+
+	c := ts.client(t)
+	res, body := ts.do(t, c, http.MethodPost, "/auth/login/2fa", Response{
+		"challenge": challenge,
+		"code":      wrongCode(t, secret),
+	})
+	if res.StatusCode != http.StatusUnauthorized || body["err"] != "Invalid Code" {
+		t.Fatalf("wrong code: %d %v", res.StatusCode, body)
+	}
+	res, body = ts.do(t, c, http.MethodPost, "/auth/login/2fa", Response{
+		"challenge": challenge,
+		"code":      currentCode(t, secret),
+	})
+	if res.StatusCode != http.StatusOK || body["success"] != true {
+		t.Fatalf("right code: %d %v", res.StatusCode, body)
+	}
+	if ts.cookie(t, c, "/", "token") == "" {
+		t.Fatal("no access token after the second factor")
+	}
+	res, _ = ts.do(t, ts.client(t), http.MethodPost, "/auth/login/2fa", Response{
+		"challenge":    challenge,
+		"recoveryCode": "recovery-one",
+	})
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("challenge worked twice: %d", res.StatusCode)
+	}
+}
+
+func TestLoginCodeReplay(t *testing.T) {
+	ts := newTestServer(t)
+	user := ts.addUser(t, "alice@example.com", "hunter22")
+	secret := enableTOTP(t, ts, user, "recovery-one")
+	code := currentCode(t, secret)
+
+	res, body := ts.do(t, ts.client(t), http.MethodPost, "/auth/login/2fa", Response{
+		"challenge": challengeFor(t, ts, "alice@example.com", "hunter22"),
+		"code":      code,
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("first use of the code: %d %v", res.StatusCode, body)
+	}
+	res, body = ts.do(t, ts.client(t), http.MethodPost, "/auth/login/2fa", Response{
+		"challenge": challengeFor(t, ts, "alice@example.com", "hunter22"),
+		"code":      code,
+	})
+	if res.StatusCode != http.StatusUnauthorized || body["err"] != "Invalid Code" {
+		t.Fatalf("code used again within its step: %d %v", res.StatusCode, body)
+	}
+}
+
+func TestLoginChallengeAttemptLimit(t *testing.T) {
+	ts := newTestServer(t)
+	user := ts.addUser(t, "bob@example.com", "hunter22")
+	secret := enableTOTP(t, ts, user, "recovery-one")
+	challenge := challengeFor(t, ts, "bob@example.com", "hunter22")
+
+	for i := 1; i < maxChallengeAttempts; i++ {
+		res, body := ts.do(t, ts.client(t), http.MethodPost, "/auth/login/2fa", Response{
+			"challenge": challenge,
+			"code":      wrongCode(t, secret),
+		})
+		if body["err"] != "Invalid Code" {
+			t.Fatalf("attempt %d: %d %v", i, res.StatusCode, body)
+		}
+	}
+	res, body := ts.do(t, ts.client(t), http.MethodPost, "/auth/login/2fa", Response{
+		"challenge": challenge,
+		"code":      wrongCode(t, secret),
+	})
+	if body["err"] != "Too Many Attempts, Log In Again" {
+		t.Fatalf("last attempt: %d %v", res.StatusCode, body)
+	}
+	res, _ = ts.do(t, ts.client(t), http.MethodPost, "/auth/login/2fa", Response{
+		"challenge": challenge,
+		"code":      currentCode(t, secret),
+	})
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("right code after running out of attempts: %d", res.StatusCode)
+	}
+}
+
+func TestLoginChallengeConcurrentGuesses(t *testing.T) {
+	ts := newTestServer(t)
+	requireMongoDB(t, "atomic conditional updates")
+	user := ts.addUser(t, "carol@example.com", "hunter22")
+	secret := enableTOTP(t, ts, user, "recovery-one")
+	challenge := challengeFor(t, ts, "carol@example.com", "hunter22")
+	guess := `{"challenge":"` + challenge + `","code":"` + wrongCode(t, secret) + `"}`
+
+	var (
+		wg      sync.WaitGroup
+		mutex   sync.Mutex
+		checked int
+	)
+	for i := 0; i < 4*maxChallengeAttempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := http.Post(ts.URL+"/auth/login/2fa", "application/json", strings.NewReader(guess))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer res.Body.Close()
+			data, _ := io.ReadAll(res.Body)
+			// Only guesses that got an attempt see their code judged.
+			if strings.Contains(string(data), "Invalid Code") || strings.Contains(string(data), "Too Many Attempts") {
+				mutex.Lock()
+				checked++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if checked > maxChallengeAttempts {
+		t.Fatalf("%d guesses were checked, want at most %d", checked, maxChallengeAttempts)
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("%d codes and %d hashes", len(codes), len(hashes))
+	}
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ReplaceAll(code, "-", ""))
+		if err != nil || len(raw)*8 < 80 {
+			t.Fatalf("code %q carries %d bits: %v", code, len(raw)*8, err)
+		}
+		if seen[code] {
+			t.Fatalf("code %q given twice", code)
+		}
+		seen[code] = true
+		// Codes are accepted however they are typed.
+		typed := strings.ToLower(strings.ReplaceAll(code, "-", " "))
+		if hashRecoveryCode(typed) != hashes[i] {
+			t.Fatalf("code %q typed as %q does not match its hash", code, typed)
+		}
+	}
+}
+
+func TestTOTPSetupNeedsPassword(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, "alice@example.com", "hunter22")
+	c := ts.login(t, "alice@example.com", "hunter22")
+
+	res, body := ts.do(t, c, http.MethodPost, "/api/2fa/totp/setup", Response{})
+	if res.StatusCode != http.StatusUnauthorized || body["err"] != "Wrong Password" {
+		t.Fatalf("setup without the password: %d %v", res.StatusCode, body)
+	}
+	res, body = ts.do(t, c, http.MethodPost, "/api/2fa/totp/setup", Response{"password": "hunter22"})
+	secret, _ := body["secret"].(string)
+	if res.StatusCode != http.StatusOK || secret == "" {
+		t.Fatalf("setup with the password: %d %v", res.StatusCode, body)
+	}
+
+	res, body = ts.do(t, c, http.MethodPost, "/api/2fa/totp/enable", Response{
+		"password": "wrong",
+		"code":     currentCode(t, secret),
+	})
+	if res.StatusCode != http.StatusUnauthorized || body["err"] != "Wrong Password" {
+		t.Fatalf("enable with a wrong password: %d %v", res.StatusCode, body)
+	}
+	res, body = ts.do(t, c, http.MethodPost, "/api/2fa/totp/enable", Response{
+		"password": "hunter22",
+		"code":     currentCode(t, secret),
+	})
+	if codes, _ := body["recoveryCodes"].([]any); res.StatusCode != http.StatusOK || len(codes) != recoveryCodeCount {
+		t.Fatalf("enable with the password: %d %v", res.StatusCode, body)
+	}
+}
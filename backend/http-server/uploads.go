@@ -0,0 +1,319 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Resumable uploads speak the core tus 1.0.0 protocol with the creation,
+// termination and expiration extensions (https://tus.io/protocols/resumable-upload).
+const (
+	tusVersion             = "1.0.0"
+	tusExtensions          = "creation,termination,expiration"
+	maxResumableUploadSize = 1 << 30
+	uploadLifetime         = 24 * time.Hour
+	uploadSweepInterval    = time.Hour
+)
+
+// parseUploadMetadata decodes the Upload-Metadata header: comma separated
+// pairs of a key and a base64 encoded value.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %q is not base64", key)
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+// chunkKey names the object one PATCH is stored as. Requests racing at the
+// same offset each get their own, so the one that loses cannot overwrite
+// or delete the chunk of the one that won.
+func chunkKey(uploadId primitive.ObjectID, offset int64) string {
+	return fmt.Sprintf("uploads/%s/%020d-%s", uploadId.Hex(), offset, primitive.NewObjectID().Hex())
+}
+
+// tus wraps handlers of the upload routes with the protocol version check
+// and the headers every response carries.
+func tus(f handlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return nil
+		}
+		return f(w, r)
+	}
+}
+
+// ownUpload loads {uploadid} and makes sure it belongs to the caller. On
+// failure the response is already written.
+func (s *Server) ownUpload(w http.ResponseWriter, r *http.Request) (*t.Upload, error) {
+	userId, err := currentUserId(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, err
+	}
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["uploadid"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, err
+	}
+	upload, err := s.store.FindUpload(id)
+	if err != nil || upload.UserId != userId {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, fmt.Errorf("upload %s not found for %s", id.Hex(), userId.Hex())
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		w.WriteHeader(http.StatusGone)
+		return nil, fmt.Errorf("upload %s expired", id.Hex())
+	}
+	return upload, nil
+}
+
+func (s *Server) handleUploadRoutes(router *mux.Router) {
+	router.HandleFunc("/uploads", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.Itoa(maxResumableUploadSize))
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodOptions)
+
+	router.HandleFunc("/uploads", m.VerifiedMiddleWare(makeHttpHandler(tus(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return err
+		}
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length <= 0 {
+			http.Error(w, "Upload-Length is required", http.StatusBadRequest)
+			return nil
+		}
+		if length > maxResumableUploadSize {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+		if err != nil || meta["chatid"] == "" || meta["filename"] == "" {
+			http.Error(w, "Upload-Metadata needs chatid and filename", http.StatusBadRequest)
+			return err
+		}
+		chat, err := s.chatForUser(meta["chatid"], userId)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return err
+		}
+		upload := &t.Upload{
+			UserId:    userId,
+			ChatId:    chat.ID,
+			Filename:  meta["filename"],
+			Caption:   meta["caption"],
+			Length:    length,
+			ExpiresAt: time.Now().Add(uploadLifetime),
+		}
+		id, err := s.store.CreateUpload(upload)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+		w.Header().Set("Location", "/api/uploads/"+id.Hex())
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	})))).Methods(http.MethodPost)
+
+	router.HandleFunc("/uploads/{uploadid}", m.AuthMiddleWare(makeHttpHandler(tus(func(w http.ResponseWriter, r *http.Request) error {
+		upload, err := s.ownUpload(w, r)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})))).Methods(http.MethodHead)
+
+	router.HandleFunc("/uploads/{uploadid}", m.AuthMiddleWare(makeHttpHandler(tus(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return nil
+		}
+		upload, err := s.ownUpload(w, r)
+		if err != nil {
+			return err
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset != upload.Offset || upload.MessageId != nil {
+			w.WriteHeader(http.StatusConflict)
+			return nil
+		}
+
+		// Each PATCH becomes its own object. The body is spooled to disk
+		// first so a request that breaks off midway still keeps the bytes
+		// that did arrive; the client resumes from the offset we return.
+		spool, err := os.CreateTemp("", "chunk-*")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		n, readErr := io.Copy(spool, io.LimitReader(r.Body, upload.Length-offset))
+		if readErr != nil {
+			log.Printf("upload %s: body broke off after %d bytes: %v", upload.ID.Hex(), n, readErr)
+		}
+		if n == 0 {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+		// The client may already be gone; storing what it sent must not
+		// depend on its request context.
+		ctx := context.WithoutCancel(r.Context())
+		key := chunkKey(upload.ID, offset)
+		if _, err := s.blobs.Put(ctx, key, spool, n, "application/octet-stream"); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+		chunk := t.UploadChunk{Key: key, Offset: offset, Size: n}
+		ok, err := s.store.AppendUploadChunk(upload.ID, chunk)
+		if err != nil || !ok {
+			s.blobs.Delete(ctx, key)
+			w.WriteHeader(http.StatusConflict)
+			return err
+		}
+		upload.Offset = offset + n
+		upload.Chunks = append(upload.Chunks, chunk)
+
+		if upload.Offset == upload.Length {
+			message, err := s.finishUpload(ctx, upload)
+			if err != nil {
+				s.discardUpload(ctx, upload)
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return err
+			}
+			w.Header().Set("Upload-Message-Id", message.ID.Hex())
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})))).Methods(http.MethodPatch)
+
+	router.HandleFunc("/uploads/{uploadid}", m.AuthMiddleWare(makeHttpHandler(tus(func(w http.ResponseWriter, r *http.Request) error {
+		upload, err := s.ownUpload(w, r)
+		if err != nil {
+			return err
+		}
+		s.discardUpload(r.Context(), upload)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})))).Methods(http.MethodDelete)
+}
+
+// finishUpload stitches the chunks back together and sends the file to
+// the chat as an attachment.
+func (s *Server) finishUpload(ctx context.Context, upload *t.Upload) (*t.Message, error) {
+	chat, err := s.chatForUser(upload.ChatId.Hex(), upload.UserId)
+	if err != nil {
+		return nil, errors.New("you are no longer part of this chat")
+	}
+	file, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	for _, chunk := range upload.Chunks {
+		body, err := s.blobs.Get(ctx, chunk.Key)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(file, body)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	messageId := primitive.NewObjectID()
+	attachment, err := s.storeAttachment(ctx, messageId, file, upload.Filename, 0)
+	if err != nil {
+		return nil, err
+	}
+	message, err := s.sendAttachments(chat, upload.UserId, messageId, []t.Attachment{*attachment}, upload.Caption)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.CompleteUpload(upload.ID, message.ID); err != nil {
+		log.Printf("CompleteUpload %s: %v", upload.ID.Hex(), err)
+	}
+	s.deleteChunks(ctx, upload)
+	return message, nil
+}
+
+func (s *Server) deleteChunks(ctx context.Context, upload *t.Upload) {
+	for _, chunk := range upload.Chunks {
+		if err := s.blobs.Delete(ctx, chunk.Key); err != nil {
+			log.Printf("delete chunk %s: %v", chunk.Key, err)
+		}
+	}
+}
+
+func (s *Server) discardUpload(ctx context.Context, upload *t.Upload) {
+	s.deleteChunks(ctx, upload)
+	if err := s.store.DeleteUpload(upload.ID); err != nil {
+		log.Printf("DeleteUpload %s: %v", upload.ID.Hex(), err)
+	}
+}
+
+// expireUploads periodically throws away uploads past their expiry, both
+// abandoned ones and finished ones kept around for late HEAD requests.
+func (s *Server) expireUploads() {
+	ticker := time.NewTicker(uploadSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		uploads, err := s.store.FindExpiredUploads(time.Now())
+		if err != nil {
+			log.Printf("FindExpiredUploads: %v", err)
+			continue
+		}
+		for i := range uploads {
+			s.discardUpload(context.Background(), &uploads[i])
+		}
+	}
+}
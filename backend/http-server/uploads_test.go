@@ -0,0 +1,107 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	types "github.com/SourishBeast7/Glooo/types"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// createUpload starts a resumable upload of length bytes to chat and
+// returns its path.
+func (ts *testServer) createUpload(t *testing.T, c *http.Client, chat *types.Chats, filename string, length int) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/uploads", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	req.Header.Set("Upload-Metadata", "chatid "+base64.StdEncoding.EncodeToString([]byte(chat.ID.Hex()))+
+		",filename "+base64.StdEncoding.EncodeToString([]byte(filename)))
+	res, _ := ts.send(t, c, req)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("create upload: %d", res.StatusCode)
+	}
+	return res.Header.Get("Location")
+}
+
+func patchRequest(t *testing.T, ts *testServer, path string, offset int, body io.Reader) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPatch, ts.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	return req
+}
+
+func TestUploadPatchesRacingAtOneOffset(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.addUser(t, "alice@example.com", "hunter22")
+	chat := addChat(t, ts, alice)
+	c := ts.login(t, "alice@example.com", "hunter22")
+	path := ts.createUpload(t, c, chat, "notes.txt", 10)
+
+	// Both PATCHes get past the offset check before either has its body,
+	// like a retry sent while the first attempt is still in flight.
+	type result struct {
+		status int
+		err    error
+	}
+	start := func(body string) (*io.PipeWriter, chan result) {
+		r, w := io.Pipe()
+		done := make(chan result, 1)
+		req := patchRequest(t, ts, path, 0, r)
+		go func() {
+			res, err := c.Do(req)
+			if err != nil {
+				done <- result{err: err}
+				return
+			}
+			res.Body.Close()
+			done <- result{status: res.StatusCode}
+		}()
+		go w.Write([]byte(body))
+		return w, done
+	}
+	first, firstDone := start("first")
+	retry, retryDone := start("retry")
+	time.Sleep(300 * time.Millisecond)
+
+	first.Close()
+	if res := <-firstDone; res.err != nil || res.status != http.StatusNoContent {
+		t.Fatalf("first PATCH: %d %v", res.status, res.err)
+	}
+	retry.Close()
+	if res := <-retryDone; res.err != nil || res.status != http.StatusConflict {
+		t.Fatalf("retried PATCH: %d %v", res.status, res.err)
+	}
+
+	res, _ := ts.send(t, c, patchRequest(t, ts, path, 5, strings.NewReader("-rest")))
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("last PATCH: %d", res.StatusCode)
+	}
+	messageId, err := primitive.ObjectIDFromHex(res.Header.Get("Upload-Message-Id"))
+	if err != nil {
+		t.Fatalf("upload did not finish: %v", err)
+	}
+	msg := ts.store.FindMessagesById(messageId)
+	if msg == nil || len(msg.Attachments) != 1 {
+		t.Fatalf("message %s has no attachment", messageId.Hex())
+	}
+	want := sha256.Sum256([]byte("first-rest"))
+	if msg.Attachments[0].Hash != hex.EncodeToString(want[:]) {
+		t.Fatal("the stored file is not what the winning PATCH sent")
+	}
+}
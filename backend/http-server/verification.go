@@ -0,0 +1,225 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	m "github.com/SourishBeast7/Glooo/http-server/middleware"
+	"github.com/SourishBeast7/Glooo/mailer"
+	t "github.com/SourishBeast7/Glooo/types"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	verificationTTL = 24 * time.Hour
+	// A new verification email can be asked for once a minute, and at most
+	// resendLimit times an hour.
+	resendCooldown = time.Minute
+	resendLimit    = 5
+)
+
+const defaultAppURL = "http://localhost:5173"
+
+// appURL is where the frontend lives, for links in emails.
+func appURL() string {
+	if v := os.Getenv("APP_URL"); v != "" {
+		return v
+	}
+	return defaultAppURL
+}
+
+// newEmailToken stores a single use token for purpose and returns it. Only
+// its hash is kept.
+func (s *Server) newEmailToken(userId primitive.ObjectID, purpose string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	now := time.Now()
+	if err := s.store.AddEmailToken(&t.EmailToken{
+		UserId:    userId,
+		Purpose:   purpose,
+		Hash:      hashToken(token),
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// sendVerification emails user a link that confirms their address.
+func (s *Server) sendVerification(ctx context.Context, user *t.MongoUser) error {
+	token, err := s.newEmailToken(user.ID, t.EmailVerification, verificationTTL)
+	if err != nil {
+		return err
+	}
+	link := appURL() + "/verify-email?token=" + url.QueryEscape(token)
+	return s.mailer.Send(ctx, &mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Text: fmt.Sprintf("Hi %s,\n\nOpen this link to confirm your email address:\n\n%s\n\n"+
+			"The link works for 24 hours. If you did not sign up, ignore this email.\n",
+			user.Name, link),
+	})
+}
+
+// userLocks hands out one mutex per user. A lock is forgotten once nobody
+// holds or waits for it.
+type userLocks struct {
+	mutex sync.Mutex
+	locks map[primitive.ObjectID]*userLock
+}
+
+type userLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock blocks until the lock of userId is free and returns its unlock.
+func (l *userLocks) lock(userId primitive.ObjectID) func() {
+	l.mutex.Lock()
+	if l.locks == nil {
+		l.locks = make(map[primitive.ObjectID]*userLock)
+	}
+	lock, ok := l.locks[userId]
+	if !ok {
+		lock = new(userLock)
+		l.locks[userId] = lock
+	}
+	lock.refs++
+	l.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if lock.refs--; lock.refs == 0 {
+			delete(l.locks, userId)
+		}
+	}
+}
+
+// emailWait returns how long user must wait before being sent another
+// email for purpose, or zero.
+func (s *Server) emailWait(userId primitive.ObjectID, purpose string) (time.Duration, error) {
+	now := time.Now()
+	recent, err := s.store.CountEmailTokens(userId, purpose, now.Add(-resendCooldown))
+	if err != nil {
+		return 0, err
+	}
+	if recent > 0 {
+		return resendCooldown, nil
+	}
+	hourly, err := s.store.CountEmailTokens(userId, purpose, now.Add(-time.Hour))
+	if err != nil {
+		return 0, err
+	}
+	if hourly >= resendLimit {
+		return time.Hour, nil
+	}
+	return 0, nil
+}
+
+// throttleEmail refuses to send user another email for purpose too soon.
+// The caller holds the user's emailLocks until the email's token is stored,
+// so that concurrent requests cannot all pass the check. On failure the
+// response is already written.
+func (s *Server) throttleEmail(w http.ResponseWriter, userId primitive.ObjectID, purpose string) error {
+	wait, err := s.emailWait(userId, purpose)
+	if err != nil {
+		WriteJson(w, http.StatusInternalServerError, Response{
+			"success": false,
+		})
+		return err
+	}
+	if wait == 0 {
+		return nil
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())))
+	WriteJson(w, http.StatusTooManyRequests, Response{
+		"err": "Too Many Emails, Try Again Later",
+	})
+	return fmt.Errorf("email to %s throttled", userId.Hex())
+}
+
+func (s *Server) handleVerificationRoutes(router *mux.Router) {
+	// After verifying, clients call /auth/refresh so that their access
+	// token stops saying the address is unverified.
+	router.HandleFunc("/verify-email", makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		body := new(struct {
+			Token string `json:"token"`
+		})
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil || body.Token == "" {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Missing Token",
+			})
+		}
+		token, err := s.store.ConsumeEmailToken(hashToken(body.Token), t.EmailVerification)
+		if err != nil {
+			return WriteJson(w, http.StatusNotAcceptable, Response{
+				"err": "Invalid Or Expired Token",
+			})
+		}
+		if err := s.store.MarkUserVerified(token.UserId); err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		if err := s.store.DeleteEmailTokens(token.UserId, t.EmailVerification); err != nil {
+			log.Printf("DeleteEmailTokens %s: %v", token.UserId.Hex(), err)
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	})).Methods(http.MethodPost)
+
+	router.HandleFunc("/verify-email/resend", m.AuthMiddleWare(makeHttpHandler(func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := currentUserId(r)
+		if err != nil {
+			return WriteJson(w, http.StatusUnauthorized, Response{
+				"err": err.Error(),
+			})
+		}
+		user, err := s.store.FindUserById(userId)
+		if err != nil {
+			WriteJson(w, http.StatusNotFound, Response{
+				"err": "User Not Found",
+			})
+			return err
+		}
+		if !user.Unverified {
+			return WriteJson(w, http.StatusConflict, Response{
+				"err": "Email Already Verified",
+			})
+		}
+		unlock := s.emailLocks.lock(user.ID)
+		defer unlock()
+		if err := s.throttleEmail(w, user.ID, t.EmailVerification); err != nil {
+			return err
+		}
+		if err := s.sendVerification(r.Context(), user); err != nil {
+			WriteJson(w, http.StatusInternalServerError, Response{
+				"success": false,
+			})
+			return err
+		}
+		return WriteJson(w, http.StatusOK, Response{
+			"success": true,
+		})
+	}))).Methods(http.MethodPost)
+}
@@ -0,0 +1,165 @@
+package httpserver
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	types "github.com/SourishBeast7/Glooo/types"
+)
+
+func TestVerifyEmail(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.client(t)
+	res, body := ts.postForm(t, c, "/auth/signup", map[string]string{
+		"name":     "Alice",
+		"email":    "alice@example.com",
+		"password": "correct horse",
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("signup: %d %v", res.StatusCode, body)
+	}
+	user, err := ts.store.FindUserByEmail("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Unverified {
+		t.Fatal("a new account starts out verified")
+	}
+	sent := ts.mail.to("alice@example.com")
+	if len(sent) != 1 {
+		t.Fatalf("signup sent %d emails, want 1", len(sent))
+	}
+	token := tokenIn(t, sent[0])
+
+	res, body = ts.do(t, c, http.MethodPost, "/auth/verify-email", Response{"token": "not-a-token"})
+	if res.StatusCode != http.StatusNotAcceptable {
+		t.Fatalf("made up token: %d %v", res.StatusCode, body)
+	}
+	res, body = ts.do(t, c, http.MethodPost, "/auth/verify-email", Response{"token": token})
+	if res.StatusCode != http.StatusOK || body["success"] != true {
+		t.Fatalf("verify: %d %v", res.StatusCode, body)
+	}
+	if user, err = ts.store.FindUserById(user.ID); err != nil || user.Unverified {
+		t.Fatalf("user is still unverified (%v)", err)
+	}
+	res, _ = ts.do(t, c, http.MethodPost, "/auth/verify-email", Response{"token": token})
+	if res.StatusCode != http.StatusNotAcceptable {
+		t.Fatalf("token worked twice: %d", res.StatusCode)
+	}
+}
+
+func TestVerifyEmailExpired(t *testing.T) {
+	ts := newTestServer(t)
+	user := ts.addUser(t, "bob@example.com", "hunter22")
+	token, err := ts.newEmailToken(user.ID, types.EmailVerification, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ := ts.do(t, ts.client(t), http.MethodPost, "/auth/verify-email", Response{"token": token})
+	if res.StatusCode != http.StatusNotAcceptable {
+		t.Fatalf("expired token: %d", res.StatusCode)
+	}
+}
+
+// sentEmails records n verification emails sent to user at the given time.
+func sentEmails(t *testing.T, ts *testServer, user *types.MongoUser, n int, at time.Time) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := ts.store.AddEmailToken(&types.EmailToken{
+			UserId:    user.ID,
+			Purpose:   types.EmailVerification,
+			Hash:      hashToken(at.String() + string(rune('a'+i))),
+			ExpiresAt: at.Add(verificationTTL),
+			CreatedAt: at,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResendVerificationThrottle(t *testing.T) {
+	ts := newTestServer(t)
+	user := ts.addUser(t, "carol@example.com", "hunter22")
+	if err := ts.store.UpdateUserDetails(user.ID, "unverified", true); err != nil {
+		t.Fatal(err)
+	}
+	c := ts.login(t, "carol@example.com", "hunter22")
+	resend := func() (*http.Response, Response) {
+		return ts.do(t, c, http.MethodPost, "/auth/verify-email/resend", nil)
+	}
+
+	// Four emails earlier this hour leave room for a fifth.
+	sentEmails(t, ts, user, resendLimit-1, time.Now().Add(-10*time.Minute))
+	res, body := resend()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("first resend: %d %v", res.StatusCode, body)
+	}
+	if n := len(ts.mail.to("carol@example.com")); n != 1 {
+		t.Fatalf("sent %d emails, want 1", n)
+	}
+
+	res, _ = resend()
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") != "60" {
+		t.Fatalf("resend within the cooldown: %d, Retry-After %q", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+	if n := len(ts.mail.to("carol@example.com")); n != 1 {
+		t.Fatalf("throttled resend still sent an email (%d in total)", n)
+	}
+}
+
+func TestResendVerificationHourlyLimit(t *testing.T) {
+	ts := newTestServer(t)
+	user := ts.addUser(t, "dave@example.com", "hunter22")
+	if err := ts.store.UpdateUserDetails(user.ID, "unverified", true); err != nil {
+		t.Fatal(err)
+	}
+	c := ts.login(t, "dave@example.com", "hunter22")
+	sentEmails(t, ts, user, resendLimit, time.Now().Add(-10*time.Minute))
+	res, _ := ts.do(t, c, http.MethodPost, "/auth/verify-email/resend", nil)
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") != "3600" {
+		t.Fatalf("resend over the hourly limit: %d, Retry-After %q", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+	if n := len(ts.mail.to("dave@example.com")); n != 0 {
+		t.Fatalf("sent %d emails over the limit", n)
+	}
+}
+
+func TestResendVerificationWhenVerified(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser(t, "erin@example.com", "hunter22")
+	c := ts.login(t, "erin@example.com", "hunter22")
+	res, _ := ts.do(t, c, http.MethodPost, "/auth/verify-email/resend", nil)
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("resend for a verified address: %d", res.StatusCode)
+	}
+}
+
+func TestSignupEmailIgnoresCase(t *testing.T) {
+	ts := newTestServer(t)
+	res, body := ts.postForm(t, ts.client(t), "/auth/signup", map[string]string{
+		"name":     "Alice",
+		"email":    "Alice@Example.com",
+		"password": "correct horse",
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("signup: %d %v", res.StatusCode, body)
+	}
+	if len(ts.mail.to("alice@example.com")) != 1 {
+		t.Fatal("no verification email to the lowercased address")
+	}
+	ts.login(t, "ALICE@example.com", "correct horse")
+
+	res, body = ts.postForm(t, ts.client(t), "/auth/signup", map[string]string{
+		"name":     "Mallory",
+		"email":    "alice@EXAMPLE.com",
+		"password": "hunter22",
+	})
+	if body["message"] != "User Already Exists" {
+		t.Fatalf("signup with the address in other case: %d %v", res.StatusCode, body)
+	}
+	// The index holds even when the check above is raced.
+	if _, err := ts.store.AddUser(&types.MongoUser{Name: "Mallory", Email: "ALICE@example.com"}); err == nil {
+		t.Fatal("a second account was stored for the same address")
+	}
+}
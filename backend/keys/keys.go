@@ -0,0 +1,287 @@
+// Package keys holds the keys our access tokens are signed and verified
+// with. Keys are PEM files named <kid>.pem in the directory JWT_KEYS_DIR;
+// all of them verify and the newest published one signs, so a key can be
+// rotated without logging anyone out. Without a directory tokens are signed with
+// HS256 and JWT_SECRET as before.
+package keys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	EdDSA = "EdDSA"
+	RS256 = "RS256"
+)
+
+// kidTime is the layout of the timestamp key ids start with, so that ids
+// sort in the order the keys were made.
+const kidTime = "20060102T150405Z"
+
+const rsaBits = 3072
+
+// PublishDelay is how long a new key is only published before it signs,
+// so that services caching our JWKS know it by the time they see it.
+const PublishDelay = 5 * time.Minute
+
+var (
+	ErrNoKeys     = errors.New("keys: no signing key configured")
+	ErrUnknownKid = errors.New("keys: unknown key id")
+)
+
+// Key is one signing key pair.
+type Key struct {
+	ID      string
+	Created time.Time
+	Method  jwt.SigningMethod
+	private crypto.Signer
+}
+
+func (k *Key) Public() crypto.PublicKey {
+	return k.private.Public()
+}
+
+// Keyset signs new tokens with its current key and verifies tokens made
+// with any of its keys.
+type Keyset struct {
+	dir    string
+	secret []byte
+
+	mutex   sync.RWMutex
+	keys    map[string]*Key
+	current *Key
+}
+
+// FromEnv loads the keys in JWT_KEYS_DIR. JWT_SECRET, when set, is still
+// accepted for HS256 tokens, and is the only key when there is no
+// directory.
+func FromEnv() (*Keyset, error) {
+	return Load(os.Getenv("JWT_KEYS_DIR"), []byte(os.Getenv("JWT_SECRET")))
+}
+
+func Load(dir string, secret []byte) (*Keyset, error) {
+	k := &Keyset{dir: dir, secret: secret}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	if k.current == nil && len(secret) == 0 {
+		return nil, ErrNoKeys
+	}
+	return k, nil
+}
+
+// Reload reads the key directory again, picking up rotated keys.
+func (k *Keyset) Reload() error {
+	if k.dir == "" {
+		return nil
+	}
+	keys, err := ReadDir(k.dir)
+	if err != nil {
+		return err
+	}
+	set := make(map[string]*Key, len(keys))
+	for _, key := range keys {
+		set[key.ID] = key
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.keys = set
+	k.current = SigningKey(keys)
+	return nil
+}
+
+// SigningKey picks the key to sign with out of keys, oldest first: the
+// newest one published for at least PublishDelay, or the oldest one when
+// none has been.
+func SigningKey(keys []*Key) *Key {
+	if len(keys) == 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-PublishDelay)
+	for i := len(keys) - 1; i >= 0; i-- {
+		if keys[i].Created.Before(cutoff) {
+			return keys[i]
+		}
+	}
+	return keys[0]
+}
+
+// Watch reloads the keys every interval.
+func (k *Keyset) Watch(interval time.Duration) {
+	if k.dir == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := k.Reload(); err != nil {
+			log.Printf("keys: reload %s: %v", k.dir, err)
+		}
+	}
+}
+
+// Sign signs claims with the current key, or with JWT_SECRET when there
+// is none.
+func (k *Keyset) Sign(claims jwt.Claims) (string, error) {
+	k.mutex.RLock()
+	current := k.current
+	k.mutex.RUnlock()
+	if current == nil {
+		if len(k.secret) == 0 {
+			return "", ErrNoKeys
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.secret)
+	}
+	token := jwt.NewWithClaims(current.Method, claims)
+	token.Header["kid"] = current.ID
+	return token.SignedString(current.private)
+}
+
+// Keyfunc finds the key a token was signed with, by its kid header.
+func (k *Keyset) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok || len(k.secret) == 0 {
+			return nil, fmt.Errorf("unrecognized signing method : %v", token.Method.Alg())
+		}
+		return k.secret, nil
+	}
+	k.mutex.RLock()
+	key := k.keys[kid]
+	k.mutex.RUnlock()
+	if key == nil {
+		return nil, ErrUnknownKid
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unrecognized signing method : %v", token.Method.Alg())
+	}
+	return key.Public(), nil
+}
+
+// Methods lists the algorithms tokens may be signed with.
+func (k *Keyset) Methods() []string {
+	methods := []string{EdDSA, RS256}
+	if len(k.secret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	return methods
+}
+
+// Keys returns the keys of the set, oldest first.
+func (k *Keyset) Keys() []*Key {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	keys := make([]*Key, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+// Generate makes a new key for alg, EdDSA or RS256.
+func Generate(alg string) (*Key, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case EdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case RS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaBits)
+	default:
+		return nil, fmt.Errorf("keys: unsupported algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	now := time.Now().UTC().Truncate(time.Second)
+	return newKey(now.Format(kidTime)+"-"+hex.EncodeToString(suffix), private)
+}
+
+func newKey(id string, private crypto.Signer) (*Key, error) {
+	created, err := time.Parse(kidTime, strings.SplitN(id, "-", 2)[0])
+	if err != nil {
+		return nil, fmt.Errorf("keys: bad key id %q", id)
+	}
+	key := &Key{ID: id, Created: created, private: private}
+	switch private.(type) {
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+	case *rsa.PrivateKey:
+		key.Method = jwt.SigningMethodRS256
+	default:
+		return nil, fmt.Errorf("keys: unsupported key type %T", private)
+	}
+	return key, nil
+}
+
+// ReadDir loads the keys in dir, oldest first.
+func ReadDir(dir string) ([]*Key, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	keys := make([]*Key, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("keys: %s is not PEM", path)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("keys: %s: %w", path, err)
+		}
+		private, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("keys: %s: unsupported key type %T", path, parsed)
+		}
+		key, err := newKey(strings.TrimSuffix(filepath.Base(path), ".pem"), private)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Write saves key to dir as <kid>.pem, readable only by its owner.
+func Write(dir string, key *Key) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.private)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return os.WriteFile(filepath.Join(dir, key.ID+".pem"), data, 0o600)
+}
+
+// Remove deletes the key with id from dir.
+func Remove(dir, id string) error {
+	return os.Remove(filepath.Join(dir, id+".pem"))
+}
@@ -0,0 +1,39 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// File appends messages to a file instead of sending them, for development
+// and tests.
+type File struct {
+	path  string
+	from  string
+	mutex sync.Mutex
+}
+
+func NewFile(path, from string) *File {
+	if from == "" {
+		from = "Glooo <no-reply@localhost>"
+	}
+	return &File{path: path, from: from}
+}
+
+func (f *File) Send(ctx context.Context, msg *Message) error {
+	if err := checkHeaders(f.from, msg); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(format(f.from, msg), "\r\n"...)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
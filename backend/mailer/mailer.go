@@ -0,0 +1,79 @@
+// Package mailer sends the emails the server needs, such as address
+// verification links. The transport is picked with MAIL_TRANSPORT.
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// FromEnv builds the mailer selected by MAIL_TRANSPORT: "smtp", or "file"
+// which appends every message to MAIL_FILE instead of sending it. Without
+// a transport SMTP is used when SMTP_ADDR is set.
+func FromEnv() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	transport := os.Getenv("MAIL_TRANSPORT")
+	if transport == "" {
+		transport = "file"
+		if os.Getenv("SMTP_ADDR") != "" {
+			transport = "smtp"
+		}
+	}
+	switch transport {
+	case "smtp":
+		return NewSMTP(
+			os.Getenv("SMTP_ADDR"),
+			os.Getenv("SMTP_USER"),
+			os.Getenv("SMTP_PASS"),
+			from,
+		)
+	case "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			path = "mail.log"
+		}
+		return NewFile(path, from), nil
+	default:
+		return nil, fmt.Errorf("mailer: unknown transport %q", transport)
+	}
+}
+
+// format renders msg as an RFC 5322 message.
+func format(from string, msg *Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Text, "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
+
+// validHeader rejects values that could smuggle extra headers in.
+func validHeader(v string) bool {
+	return !strings.ContainsAny(v, "\r\n")
+}
+
+func checkHeaders(from string, msg *Message) error {
+	if !validHeader(from) || !validHeader(msg.To) || !validHeader(msg.Subject) {
+		return fmt.Errorf("mailer: header contains a line break")
+	}
+	return nil
+}
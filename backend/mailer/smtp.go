@@ -0,0 +1,57 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"net/smtp"
+)
+
+// SMTP hands messages to a mail server, upgrading to TLS when the server
+// offers STARTTLS. It works just as well against a local sink such as
+// MailHog.
+type SMTP struct {
+	addr string
+	host string
+	auth smtp.Auth
+	from string
+}
+
+func NewSMTP(addr, user, pass, from string) (*SMTP, error) {
+	if addr == "" {
+		return nil, errors.New("mailer: SMTP_ADDR is not set")
+	}
+	if from == "" {
+		return nil, errors.New("mailer: MAIL_FROM is not set")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &SMTP{addr: addr, host: host, from: from}
+	if user != "" {
+		s.auth = smtp.PlainAuth("", user, pass, host)
+	}
+	return s, nil
+}
+
+func (s *SMTP) Send(ctx context.Context, msg *Message) error {
+	if err := checkHeaders(s.from, msg); err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(s.from)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.addr, s.auth, from.Address, []string{msg.To}, format(s.from, msg))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
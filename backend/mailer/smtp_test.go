@@ -0,0 +1,204 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// envelope is one message as an SMTP server received it.
+type envelope struct {
+	from string
+	to   []string
+	data string
+}
+
+// smtpSink is an in-process SMTP server that accepts everything, without
+// STARTTLS or AUTH, and keeps what it was sent.
+type smtpSink struct {
+	addr string
+
+	mutex    sync.Mutex
+	received []envelope
+	conns    int
+	// mute makes the sink accept connections but never greet.
+	mute bool
+}
+
+func newSMTPSink(t *testing.T, mute bool) *smtpSink {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	sink := &smtpSink{addr: ln.Addr().String(), mute: mute}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+	return sink
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	s.mutex.Lock()
+	s.conns++
+	s.mutex.Unlock()
+	if s.mute {
+		io.Copy(io.Discard, conn)
+		return
+	}
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	reply("220 sink ESMTP")
+	var env envelope
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			reply("250 sink")
+		case "MAIL":
+			env = envelope{from: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+			reply("250 OK")
+		case "RCPT":
+			env.to = append(env.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			reply("250 OK")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			env.data = data.String()
+			s.mutex.Lock()
+			s.received = append(s.received, env)
+			s.mutex.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (s *smtpSink) messages() []envelope {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]envelope(nil), s.received...)
+}
+
+func (s *smtpSink) connections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conns
+}
+
+func TestSMTPSend(t *testing.T) {
+	sink := newSMTPSink(t, false)
+	m, err := NewSMTP(sink.addr, "", "", "Glooo <no-reply@glooo.test>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Send(context.Background(), &Message{
+		To:      "alice@example.com",
+		Subject: "Confirm your email address",
+		Text:    "Hi Alice,\n\nOpen this link.\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := sink.messages()
+	if len(received) != 1 {
+		t.Fatalf("sink got %d messages, want 1", len(received))
+	}
+	env := received[0]
+	if env.from != "no-reply@glooo.test" {
+		t.Errorf("MAIL FROM = %q, want the bare address", env.from)
+	}
+	if len(env.to) != 1 || env.to[0] != "alice@example.com" {
+		t.Errorf("RCPT TO = %q", env.to)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(env.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for header, want := range map[string]string{
+		"From":         "Glooo <no-reply@glooo.test>",
+		"To":           "alice@example.com",
+		"Subject":      "Confirm your email address",
+		"Mime-Version": "1.0",
+		"Content-Type": "text/plain; charset=utf-8",
+	} {
+		if got := msg.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("Date: %v", err)
+	}
+	body, _ := io.ReadAll(msg.Body)
+	if string(body) != "Hi Alice,\r\n\r\nOpen this link.\r\n\r\n" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestSMTPRejectsHeaderInjection(t *testing.T) {
+	sink := newSMTPSink(t, false)
+	m, err := NewSMTP(sink.addr, "", "", "no-reply@glooo.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, msg := range map[string]*Message{
+		"subject": {To: "alice@example.com", Subject: "Hello\r\nBcc: eve@example.com", Text: "hi"},
+		"to":      {To: "alice@example.com\nBcc: eve@example.com", Subject: "Hello", Text: "hi"},
+	} {
+		if err := m.Send(context.Background(), msg); err == nil {
+			t.Errorf("%s: Send accepted a header with a line break", name)
+		}
+	}
+	if n := sink.connections(); n != 0 {
+		t.Errorf("sink saw %d connections, want none", n)
+	}
+}
+
+func TestSMTPHonoursContext(t *testing.T) {
+	sink := newSMTPSink(t, true)
+	m, err := NewSMTP(sink.addr, "", "", "no-reply@glooo.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = m.Send(ctx, &Message{To: "alice@example.com", Subject: "Hello", Text: "hi"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
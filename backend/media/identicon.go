@@ -0,0 +1,79 @@
+package media
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+)
+
+const (
+	identiconSize  = 512
+	identiconCells = 5
+)
+
+var identiconBackground = color.RGBA{R: 240, G: 240, B: 240, A: 255}
+
+// Identicon draws a default avatar for seed as PNG: a left-right symmetric
+// 5x5 pattern in a colour taken from the seed's hash. The same seed always
+// gives the same picture.
+func Identicon(seed string) ([]byte, error) {
+	sum := sha256.Sum256([]byte(seed))
+	hue := float64(binary.BigEndian.Uint16(sum[:2])) / 65536 * 360
+	fg := &image.Uniform{hsl(hue, 0.55, 0.5)}
+
+	img := image.NewRGBA(image.Rect(0, 0, identiconSize, identiconSize))
+	draw.Draw(img, img.Bounds(), &image.Uniform{identiconBackground}, image.Point{}, draw.Src)
+	margin := identiconSize / 10
+	cell := (identiconSize - 2*margin) / identiconCells
+	half := (identiconCells + 1) / 2
+	for row := 0; row < identiconCells; row++ {
+		for col := 0; col < half; col++ {
+			if sum[2+row*half+col]&1 == 0 {
+				continue
+			}
+			for _, c := range []int{col, identiconCells - 1 - col} {
+				x, y := margin+c*cell, margin+row*cell
+				draw.Draw(img, image.Rect(x, y, x+cell, y+cell), fg, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// hsl converts a hue in degrees, saturation and lightness to RGB.
+func hsl(h, s, l float64) color.RGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return color.RGBA{
+		R: uint8(math.Round((r + m) * 255)),
+		G: uint8(math.Round((g + m) * 255)),
+		B: uint8(math.Round((b + m) * 255)),
+		A: 255,
+	}
+}
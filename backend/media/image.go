@@ -0,0 +1,206 @@
+// Package media decodes uploaded images and produces the cleaned up
+// renditions that are actually stored.
+package media
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// Images are fully decoded in memory, so refuse anything that would
+	// expand beyond this many pixels.
+	maxPixels   = 40_000_000
+	jpegQuality = 85
+
+	// MaxSize is the largest encoded image Process reads into memory.
+	MaxSize = 25 << 20
+)
+
+var (
+	ErrNotImage = errors.New("media: file is not a supported image")
+	ErrTooLarge = fmt.Errorf("media: image is larger than %d MB", MaxSize>>20)
+)
+
+// imageTypes are the formats we decode, keyed by their sniffed MIME type.
+var imageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Variant describes one rendition to produce. Images are scaled down to fit
+// within Size pixels on their longest edge, or cropped to a Size square.
+type Variant struct {
+	Name   string
+	Size   int
+	Square bool
+}
+
+var (
+	AvatarVariants = []Variant{
+		{Name: "large", Size: 512},
+		{Name: "medium", Size: 256},
+		{Name: "thumb", Size: 64, Square: true},
+	}
+	AttachmentVariants = []Variant{
+		{Name: "preview", Size: 1280},
+		{Name: "thumb", Size: 320, Square: true},
+	}
+)
+
+// Rendition is an encoded image ready to be stored under Name, which is
+// derived from its contents.
+type Rendition struct {
+	Variant string
+	Name    string
+	Mime    string
+	Hash    string
+	Width   int
+	Height  int
+	Data    []byte
+}
+
+type Processed struct {
+	Original *Rendition
+	Variants []*Rendition
+	// BlurHash and Color let clients paint a placeholder before the image
+	// has loaded.
+	BlurHash string
+	Color    string
+}
+
+// IsImage sniffs the leading bytes of a file and reports whether it is an
+// image format we can process.
+func IsImage(head []byte) (string, bool) {
+	mime := http.DetectContentType(head)
+	return mime, imageTypes[mime]
+}
+
+// Decodable reports whether images of the MIME type are ones we process.
+func Decodable(mime string) bool {
+	return imageTypes[mime]
+}
+
+// Process decodes an uploaded image, trusting only its contents, and
+// re-encodes it together with the requested variants. Re-encoding drops all
+// metadata, EXIF and GPS data included; the EXIF orientation is applied to
+// the pixels first so photos keep facing the right way. Animated GIFs are
+// kept as uploaded since GIF carries no EXIF and re-encoding would flatten
+// them.
+func Process(r io.Reader, variants []Variant) (*Processed, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxSize {
+		return nil, ErrTooLarge
+	}
+	mime, ok := IsImage(data)
+	if !ok {
+		return nil, ErrNotImage
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrNotImage
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, fmt.Errorf("media: image is larger than %d pixels", maxPixels)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrNotImage
+	}
+	if mime == "image/jpeg" {
+		img = orient(img, jpegOrientation(data))
+	}
+
+	processed := new(Processed)
+	processed.BlurHash, processed.Color = placeholder(img)
+	if mime == "image/gif" {
+		processed.Original = rendition("original", "image/gif", ".gif", data, cfg.Width, cfg.Height)
+	} else {
+		if processed.Original, err = encode("original", img); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range variants {
+		r, err := encode(v.Name, resize(img, v))
+		if err != nil {
+			return nil, err
+		}
+		processed.Variants = append(processed.Variants, r)
+	}
+	return processed, nil
+}
+
+// encode writes opaque images as JPEG and anything with transparency as PNG.
+func encode(variant string, img image.Image) (*Rendition, error) {
+	buf := new(bytes.Buffer)
+	b := img.Bounds()
+	if opaque(img) {
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, err
+		}
+		return rendition(variant, "image/jpeg", ".jpg", buf.Bytes(), b.Dx(), b.Dy()), nil
+	}
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return rendition(variant, "image/png", ".png", buf.Bytes(), b.Dx(), b.Dy()), nil
+}
+
+func rendition(variant, mime, ext string, data []byte, width, height int) *Rendition {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	return &Rendition{
+		Variant: variant,
+		Name:    hash + ext,
+		Mime:    mime,
+		Hash:    hash,
+		Width:   width,
+		Height:  height,
+		Data:    data,
+	}
+}
+
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// resize scales img down to fit the variant. Images that are already small
+// enough are only copied, never scaled up.
+func resize(img image.Image, v Variant) image.Image {
+	src := img.Bounds()
+	if v.Square {
+		side := min(src.Dx(), src.Dy())
+		x := src.Min.X + (src.Dx()-side)/2
+		y := src.Min.Y + (src.Dy()-side)/2
+		src = image.Rect(x, y, x+side, y+side)
+	}
+	w, h := src.Dx(), src.Dy()
+	if longest := max(w, h); longest > v.Size {
+		w = max(1, w*v.Size/longest)
+		h = max(1, h*v.Size/longest)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	return dst
+}
@@ -0,0 +1,147 @@
+package media
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// Placeholders are computed from a tiny copy of the image; blurhash keeps
+// only low frequencies anyway.
+const placeholderSize = 32
+
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// placeholder returns the blurhash and dominant colour of img.
+func placeholder(img image.Image) (string, string) {
+	small := resize(img, Variant{Size: placeholderSize}).(*image.RGBA)
+	x, y := 4, 3
+	if b := small.Bounds(); b.Dy() > b.Dx() {
+		x, y = 3, 4
+	}
+	return BlurHash(small, x, y), DominantColor(small)
+}
+
+// BlurHash encodes img with the given number of horizontal and vertical
+// components, as described at https://blurha.sh.
+func BlurHash(img image.Image, xComponents, yComponents int) string {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for py := 0; py < h; py++ {
+				for px := 0; px < w; px++ {
+					basis := norm *
+						math.Cos(math.Pi*float64(i)*float64(px)/float64(w)) *
+						math.Cos(math.Pi*float64(j)*float64(py)/float64(h))
+					r, g, bl, _ := img.At(b.Min.X+px, b.Min.Y+py).RGBA()
+					f[0] += basis * srgbToLinear(r>>8)
+					f[1] += basis * srgbToLinear(g>>8)
+					f[2] += basis * srgbToLinear(bl>>8)
+				}
+			}
+			scale := 1 / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encode83((xComponents-1)+(yComponents-1)*9, 1))
+	maxValue := 1.0
+	ac := factors[1:]
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		hash.WriteString(encode83(quantisedMax, 1))
+	} else {
+		hash.WriteString(encode83(0, 1))
+	}
+	dc := factors[0]
+	hash.WriteString(encode83(linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4))
+	for _, f := range ac {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encode83(q(f[0])*19*19+q(f[1])*19+q(f[2]), 2))
+	}
+	return hash.String()
+}
+
+// DominantColor returns the most common colour of img as #rrggbb, after
+// grouping similar colours and skipping mostly transparent pixels.
+func DominantColor(img image.Image) string {
+	type bucket struct {
+		n       int
+		r, g, b uint32
+	}
+	buckets := make(map[uint32]*bucket)
+	var best *bucket
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			r, g, bl = r>>8, g>>8, bl>>8
+			key := (r>>4)<<8 | (g>>4)<<4 | bl>>4
+			c := buckets[key]
+			if c == nil {
+				c = new(bucket)
+				buckets[key] = c
+			}
+			c.n++
+			c.r += r
+			c.g += g
+			c.b += bl
+			if best == nil || c.n > best.n {
+				best = c
+			}
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	n := uint32(best.n)
+	return fmt.Sprintf("#%02x%02x%02x", best.r/n, best.g/n, best.b/n)
+}
+
+func encode83(value, length int) string {
+	out := make([]byte, length)
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		out[i-1] = base83[digit]
+	}
+	return string(out)
+}
+
+func srgbToLinear(v uint32) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,136 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	clamdChunkSize = 64 << 10
+	clamdTimeout   = 2 * time.Minute
+)
+
+// Clamd streams files to a ClamAV daemon with the INSTREAM command. See
+// clamd(8) for the protocol.
+type Clamd struct {
+	Network string
+	Addr    string
+	Timeout time.Duration
+}
+
+func NewClamd(addr string) *Clamd {
+	network := "tcp"
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		network, addr = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "tcp://"):
+		addr = strings.TrimPrefix(addr, "tcp://")
+	}
+	return &Clamd{Network: network, Addr: addr, Timeout: clamdTimeout}
+}
+
+func (c *Clamd) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("scanner: %w", err)
+	}
+	deadline := time.Now().Add(c.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+// Ping checks that the daemon is up.
+func (c *Clamd) Ping(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return fmt.Errorf("scanner: %w", err)
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("scanner: unexpected reply %q", reply)
+	}
+	return nil
+}
+
+// Scan sends r in length prefixed chunks terminated by an empty one. The
+// daemon answers "stream: OK", "stream: <name> FOUND" or "<reason> ERROR".
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (*Verdict, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, fmt.Errorf("scanner: %w", err)
+	}
+
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				// The daemon hangs up once the stream is over its
+				// limit, so its reply says more than the write error.
+				if reply, rerr := readReply(conn); rerr == nil {
+					return parseReply(reply)
+				}
+				return nil, fmt.Errorf("scanner: %w", werr)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, fmt.Errorf("scanner: %w", err)
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		return nil, err
+	}
+	return parseReply(reply)
+}
+
+// readReply reads one null terminated answer.
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", fmt.Errorf("scanner: %w", err)
+	}
+	return strings.TrimSpace(strings.TrimRight(reply, "\x00")), nil
+}
+
+func parseReply(reply string) (*Verdict, error) {
+	_, result, _ := strings.Cut(reply, ": ")
+	switch {
+	case result == "OK":
+		return &Verdict{Clean: true}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return &Verdict{Threat: strings.TrimSuffix(result, " FOUND")}, nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return nil, ErrTooLarge
+	default:
+		return nil, fmt.Errorf("scanner: clamd replied %q", reply)
+	}
+}
@@ -0,0 +1,164 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd speaks just enough of the clamd protocol for Clamd. reply
+// decides the answer to a finished INSTREAM; limit makes it hang up like
+// clamd's StreamMaxLength once more bytes arrive; silent makes it never
+// answer at all.
+type fakeClamd struct {
+	addr   string
+	reply  func(data []byte) string
+	limit  int
+	silent bool
+}
+
+func newFakeClamd(t *testing.T, f *fakeClamd) *Clamd {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	f.addr = ln.Addr().String()
+	return NewClamd(f.addr)
+}
+
+func (f *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	command, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	switch strings.TrimSuffix(command, "\x00") {
+	case "zPING":
+		conn.Write([]byte("PONG\x00"))
+	case "zINSTREAM":
+		var data []byte
+		for {
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return
+			}
+			data = append(data, chunk...)
+			if f.limit > 0 && len(data) > f.limit {
+				conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				return
+			}
+		}
+		if f.silent {
+			io.Copy(io.Discard, r)
+			return
+		}
+		conn.Write([]byte(f.reply(data) + "\x00"))
+	default:
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
+
+// eicarReply flags anything containing the EICAR marker, as clamd would.
+func eicarReply(data []byte) string {
+	if bytes.Contains(data, []byte("EICAR")) {
+		return "stream: Eicar-Test-Signature FOUND"
+	}
+	return "stream: OK"
+}
+
+func TestClamdPing(t *testing.T) {
+	c := newFakeClamd(t, &fakeClamd{reply: eicarReply})
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClamdClean(t *testing.T) {
+	c := newFakeClamd(t, &fakeClamd{reply: eicarReply})
+	// Larger than one chunk, so the stream is split.
+	body := bytes.Repeat([]byte("hello "), clamdChunkSize/3)
+	verdict, err := c.Scan(context.Background(), bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verdict.Clean || verdict.Threat != "" {
+		t.Fatalf("verdict = %+v, want clean", verdict)
+	}
+}
+
+func TestClamdFound(t *testing.T) {
+	c := newFakeClamd(t, &fakeClamd{reply: eicarReply})
+	verdict, err := c.Scan(context.Background(), strings.NewReader("X5O!P%@AP EICAR-STANDARD-ANTIVIRUS-TEST-FILE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verdict.Clean || verdict.Threat != "Eicar-Test-Signature" {
+		t.Fatalf("verdict = %+v, want Eicar-Test-Signature", verdict)
+	}
+}
+
+func TestClamdSizeLimit(t *testing.T) {
+	c := newFakeClamd(t, &fakeClamd{reply: eicarReply, limit: 1 << 10})
+	body := bytes.Repeat([]byte{'a'}, 4*clamdChunkSize)
+	_, err := c.Scan(context.Background(), bytes.NewReader(body))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("err = %v, want ErrTooLarge", err)
+	}
+}
+
+func TestClamdError(t *testing.T) {
+	c := newFakeClamd(t, &fakeClamd{reply: func([]byte) string { return "stream: Can't allocate memory ERROR" }})
+	verdict, err := c.Scan(context.Background(), strings.NewReader("data"))
+	if err == nil || errors.Is(err, ErrTooLarge) {
+		t.Fatalf("verdict = %+v, err = %v, want a scan error", verdict, err)
+	}
+}
+
+func TestClamdTimeout(t *testing.T) {
+	c := newFakeClamd(t, &fakeClamd{silent: true})
+	c.Timeout = 200 * time.Millisecond
+	start := time.Now()
+	_, err := c.Scan(context.Background(), strings.NewReader("data"))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Scan took %v", elapsed)
+	}
+}
+
+func TestClamdContextDeadline(t *testing.T) {
+	c := newFakeClamd(t, &fakeClamd{silent: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := c.Scan(ctx, strings.NewReader("data")); err == nil {
+		t.Fatal("Scan succeeded without a reply")
+	}
+}
@@ -0,0 +1,43 @@
+// Package scanner checks uploaded files for malware before they are shown
+// to anyone but their sender. The scanner is picked with CLAMD_ADDR.
+package scanner
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+// ErrTooLarge is returned when the daemon refuses a file for its size.
+var ErrTooLarge = errors.New("scanner: file exceeds the scan size limit")
+
+type Verdict struct {
+	Clean bool
+	// Threat names what was found when the file is not clean.
+	Threat string
+}
+
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (*Verdict, error)
+}
+
+// Nop passes every file. It is used when no daemon is configured.
+type Nop struct{}
+
+func (Nop) Scan(ctx context.Context, r io.Reader) (*Verdict, error) {
+	return &Verdict{Clean: true}, nil
+}
+
+// FromEnv connects to the clamd given by CLAMD_ADDR, either host:port,
+// tcp://host:port or unix:///path/to/clamd.sock. Files are not scanned
+// when it is unset.
+func FromEnv() Scanner {
+	addr := os.Getenv("CLAMD_ADDR")
+	if addr == "" {
+		log.Println("⚠️ CLAMD_ADDR not set, attachments will not be scanned")
+		return Nop{}
+	}
+	return NewClamd(addr)
+}
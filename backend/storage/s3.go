@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Store keeps objects in a bucket of any S3 compatible service, such as
+// AWS S3 or a local MinIO.
+type S3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewS3Store(endpoint, accessKey, secretKey, bucket, region string, useSSL bool) (*S3Store, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("storage: S3_ENDPOINT and S3_BUCKET must be set")
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+		Region: region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3Store{
+		client: client,
+		bucket: bucket,
+	}, nil
+}
+
+func notFound(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return err
+}
+
+// s3PartSize bounds the buffer PutObject allocates for streams of unknown
+// size. Left alone, minio picks parts large enough for a 5 TiB object,
+// about 550 MiB each.
+const s3PartSize = 16 << 20
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) {
+	opts := minio.PutObjectOptions{
+		ContentType: contentType,
+	}
+	if size < 0 {
+		opts.PartSize = s3PartSize
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, opts)
+	if err != nil {
+		return "", err
+	}
+	return s.client.EndpointURL().JoinPath(s.bucket, key).String(), nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, notFound(err)
+	}
+	// GetObject is lazy; stat it so missing keys fail here and not on the
+	// first read.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, notFound(err)
+	}
+	return obj, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *S3Store) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+	}, nil
+}
+
+func (s *S3Store) SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, key, ttl, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
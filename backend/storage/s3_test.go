@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is just enough of the S3 API for S3Store: single and multipart
+// uploads, reads, stats and deletes in one bucket.
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	types   map[string]string
+	uploads map[string]map[int][]byte
+	// partSizes records the size of every multipart part received.
+	partSizes []int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3Store) {
+	t.Helper()
+	f := &fakeS3{
+		objects: make(map[string][]byte),
+		types:   make(map[string]string),
+		uploads: make(map[string]map[int][]byte),
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	endpoint := strings.TrimPrefix(server.URL, "http://")
+	store, err := NewS3Store(endpoint, "access", "secret", "bucket", "us-east-1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, store
+}
+
+// readBody undoes the chunked encodings minio streams uploads with.
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var body bytes.Buffer
+	reader := bufio.NewReader(r.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return body.Bytes(), nil
+		}
+		if _, err := io.CopyN(&body, reader, size); err != nil {
+			return nil, err
+		}
+		if _, err := reader.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		id := fmt.Sprintf("upload-%d", len(f.uploads)+1)
+		f.uploads[id] = make(map[int][]byte)
+		f.types[key] = r.Header.Get("Content-Type")
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, id)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		data, err := readBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")][n] = data
+		f.partSizes = append(f.partSizes, len(data))
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts := f.uploads[query.Get("uploadId")]
+		var data []byte
+		for i := 1; i <= len(parts); i++ {
+			data = append(data, parts[i]...)
+		}
+		f.objects[key] = data
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>`, key, etag(data))
+	case r.Method == http.MethodPut:
+		data, err := readBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = data
+		f.types[key] = r.Header.Get("Content-Type")
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", f.types[key])
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusNotImplemented)
+	}
+}
+
+func TestS3PutKnownSize(t *testing.T) {
+	fake, store := newFakeS3(t)
+	ctx := context.Background()
+	data := []byte("hello world")
+	location, err := store.Put(ctx, "a/b.txt", bytes.NewReader(data), int64(len(data)), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := url.Parse(location); err != nil || u.Path != "/bucket/a/b.txt" {
+		t.Errorf("location = %q", location)
+	}
+	if got := fake.objects["a/b.txt"]; !bytes.Equal(got, data) {
+		t.Errorf("stored %q, want %q", got, data)
+	}
+
+	body, err := store.Get(ctx, "a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Get = %q, %v", got, err)
+	}
+
+	info, err := store.Head(ctx, "a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(data)) || info.ContentType != "text/plain" {
+		t.Errorf("Head = %+v", info)
+	}
+}
+
+// An unknown size must not make minio buffer a part of hundreds of MiB.
+func TestS3PutUnknownSizeUsesBoundedParts(t *testing.T) {
+	fake, store := newFakeS3(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), (s3PartSize+s3PartSize/2)/16)
+	if _, err := store.Put(context.Background(), "big.bin", bytes.NewReader(data), -1, "application/octet-stream"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fake.objects["big.bin"], data) {
+		t.Fatalf("stored %d bytes, want %d", len(fake.objects["big.bin"]), len(data))
+	}
+	if len(fake.partSizes) != 2 {
+		t.Fatalf("parts = %v, want two", fake.partSizes)
+	}
+	for _, size := range fake.partSizes {
+		if size > s3PartSize {
+			t.Errorf("part of %d bytes exceeds %d", size, s3PartSize)
+		}
+	}
+}
+
+func TestS3Missing(t *testing.T) {
+	_, store := newFakeS3(t)
+	ctx := context.Background()
+	if _, err := store.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get err = %v, want ErrNotFound", err)
+	}
+	if _, err := store.Head(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Head err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestS3Delete(t *testing.T) {
+	fake, store := newFakeS3(t)
+	ctx := context.Background()
+	if _, err := store.Put(ctx, "gone", strings.NewReader("x"), 1, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(ctx, "gone"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["gone"]; ok {
+		t.Error("object still stored after Delete")
+	}
+}
@@ -0,0 +1,70 @@
+// Package storage hides where uploaded files live behind the BlobStore
+// interface. The backend is picked with the STORAGE_BACKEND variable.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	ErrNotFound           = errors.New("storage: object not found")
+	ErrSigningUnsupported = errors.New("storage: signed urls are not configured")
+)
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+}
+
+type BlobStore interface {
+	// Put stores the object under key and returns its location. Pass -1 as
+	// size when it is not known up front.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error)
+	// Get opens the object. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	Head(ctx context.Context, key string) (*ObjectInfo, error)
+	// SignedURL returns a URL anyone can fetch the object from until ttl
+	// has passed.
+	SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+// FromEnv builds the store selected by STORAGE_BACKEND: "bunny" (the
+// default), "s3" or "local".
+func FromEnv() (BlobStore, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "bunny":
+		return NewBunnyStore(
+			os.Getenv("BUNNYCDNHOST"),
+			os.Getenv("BUNNYCDNSZONE"),
+			os.Getenv("BUNNYCDNPASS"),
+			os.Getenv("BUNNYCDNPULLZONE"),
+			os.Getenv("BUNNYCDNTOKENKEY"),
+		), nil
+	case "s3":
+		return NewS3Store(
+			os.Getenv("S3_ENDPOINT"),
+			os.Getenv("S3_ACCESS_KEY"),
+			os.Getenv("S3_SECRET_KEY"),
+			os.Getenv("S3_BUCKET"),
+			os.Getenv("S3_REGION"),
+			os.Getenv("S3_USE_SSL") != "false",
+		)
+	case "local":
+		return NewLocalStore(
+			os.Getenv("LOCAL_STORAGE_DIR"),
+			os.Getenv("LOCAL_STORAGE_URL"),
+			[]byte(os.Getenv("LOCAL_STORAGE_SECRET")),
+		)
+	default:
+		return nil, fmt.Errorf("storage: unknown backend %q", backend)
+	}
+}
@@ -0,0 +1,91 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of RFC 6238 Appendix B, "12345678901234567890".
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238(t *testing.T) {
+	// The RFC lists eight digit codes; six digit codes are their last six.
+	vectors := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, v := range vectors {
+		at := time.Unix(v.unix, 0)
+		code, err := Code(rfcSecret, Step(at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := v.want[len(v.want)-Digits:]; code != want {
+			t.Errorf("code at %d: got %s, want %s", v.unix, code, want)
+		}
+		if _, ok := Validate(rfcSecret, code, at); !ok {
+			t.Errorf("code at %d does not validate", v.unix)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := Step(now)
+	for offset := int64(-Skew - 1); offset <= Skew+1; offset++ {
+		code, err := Code(rfcSecret, step+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := Validate(rfcSecret, code, now)
+		if within := offset >= -Skew && offset <= Skew; ok != within {
+			t.Errorf("code %d steps off: valid %v", offset, ok)
+		} else if ok && got != step+offset {
+			t.Errorf("code %d steps off: step %d, want %d", offset, got, step+offset)
+		}
+	}
+}
+
+func TestValidateSameStepWithinPeriod(t *testing.T) {
+	// Callers refuse a code whose step was used already, so a code must
+	// report the same step for as long as it is shown.
+	start := time.Unix(Step(time.Unix(1234567890, 0))*int64(Period.Seconds()), 0)
+	code, err := Code(rfcSecret, Step(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, ok := Validate(rfcSecret, code, start)
+	if !ok {
+		t.Fatal("code does not validate at the start of its step")
+	}
+	again, ok := Validate(rfcSecret, code, start.Add(Period-time.Second))
+	if !ok || again != first {
+		t.Fatalf("code at the end of its step: step %d, %v, want %d", again, ok, first)
+	}
+	next, err := Code(rfcSecret, Step(start)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step, ok := Validate(rfcSecret, next, start.Add(Period)); !ok || step <= first {
+		t.Fatalf("next code: step %d, %v, want after %d", step, ok, first)
+	}
+}
+
+func TestValidateMalformed(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "2870822", "abcdef"} {
+		if _, ok := Validate(rfcSecret, code, now); ok {
+			t.Errorf("%q validates", code)
+		}
+	}
+	if _, ok := Validate(rfcSecret, "287 082", now); !ok {
+		t.Error("a code typed with a space does not validate")
+	}
+}
@@ -0,0 +1,277 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	KindText     = "text"
+	KindImage    = "image"
+	KindFile     = "file"
+	KindAudio    = "audio"
+	KindLocation = "location"
+	KindContact  = "contact"
+)
+
+const (
+	maxTextLength    = 4096
+	maxCaptionLength = 1024
+	maxNameLength    = 256
+	maxContactFields = 10
+	previewLength    = 100
+)
+
+// MessageContent is the typed body of a message. Kind says which one of the
+// payload fields is set; all the others stay nil.
+type MessageContent struct {
+	Kind     string           `json:"kind"`
+	Text     *TextContent     `bson:"text,omitempty" json:"text,omitempty"`
+	Media    *MediaContent    `bson:"media,omitempty" json:"media,omitempty"`
+	Location *LocationContent `bson:"location,omitempty" json:"location,omitempty"`
+	Contact  *ContactContent  `bson:"contact,omitempty" json:"contact,omitempty"`
+	Render   *RenderHints     `bson:"-" json:"render,omitempty"`
+}
+
+type TextContent struct {
+	Body string `json:"body"`
+}
+
+// MediaContent is the payload of image, file and audio messages. Media
+// uploaded to the chat refers to its attachment instead of carrying a URL.
+type MediaContent struct {
+	AttachmentId *primitive.ObjectID `bson:"attachmentid,omitempty" json:"attachmentId,omitempty"`
+	URL          string              `json:"url"`
+	Name         string              `json:"name,omitempty"`
+	Mime         string              `json:"mime,omitempty"`
+	Size         int64               `json:"size,omitempty"`
+	Width        int                 `json:"width,omitempty"`
+	Height       int                 `json:"height,omitempty"`
+	Duration     float64             `json:"duration,omitempty"`
+	Caption      string              `json:"caption,omitempty"`
+	Placeholder  *Placeholder        `bson:"placeholder,omitempty" json:"placeholder,omitempty"`
+}
+
+type LocationContent struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Name      string  `json:"name,omitempty"`
+	Address   string  `json:"address,omitempty"`
+}
+
+type ContactContent struct {
+	Name   string   `json:"name"`
+	Phones []string `json:"phones,omitempty"`
+	Emails []string `json:"emails,omitempty"`
+}
+
+// RenderHints tell clients how to lay a message out without having to know
+// every kind. They are derived from the content and never stored.
+type RenderHints struct {
+	Layout      string  `json:"layout"`
+	Icon        string  `json:"icon,omitempty"`
+	Preview     string  `json:"preview"`
+	AspectRatio float64 `json:"aspectRatio,omitempty"`
+}
+
+// TextMessageContent wraps plain text, which is also how messages stored
+// before typed content existed are presented.
+func TextMessageContent(body string) *MessageContent {
+	return &MessageContent{
+		Kind: KindText,
+		Text: &TextContent{Body: body},
+	}
+}
+
+// Validate checks that exactly the payload matching Kind is set and that it
+// is well formed.
+func (c *MessageContent) Validate() error {
+	set := 0
+	for _, present := range []bool{c.Text != nil, c.Media != nil, c.Location != nil, c.Contact != nil} {
+		if present {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("content must carry exactly one payload")
+	}
+	switch c.Kind {
+	case KindText:
+		if c.Text == nil {
+			return errors.New("text content requires a text payload")
+		}
+		return c.Text.validate()
+	case KindImage, KindFile, KindAudio:
+		if c.Media == nil {
+			return fmt.Errorf("%s content requires a media payload", c.Kind)
+		}
+		return c.Media.validate(c.Kind)
+	case KindLocation:
+		if c.Location == nil {
+			return errors.New("location content requires a location payload")
+		}
+		return c.Location.validate()
+	case KindContact:
+		if c.Contact == nil {
+			return errors.New("contact content requires a contact payload")
+		}
+		return c.Contact.validate()
+	}
+	return fmt.Errorf("unknown content kind %q", c.Kind)
+}
+
+func (c *TextContent) validate() error {
+	if strings.TrimSpace(c.Body) == "" {
+		return errors.New("text is empty")
+	}
+	if utf8.RuneCountInString(c.Body) > maxTextLength {
+		return fmt.Errorf("text is longer than %d characters", maxTextLength)
+	}
+	return nil
+}
+
+func (c *MediaContent) validate(kind string) error {
+	if c.AttachmentId == nil {
+		u, err := url.Parse(c.URL)
+		if err != nil || c.URL == "" {
+			return errors.New("media url is invalid")
+		}
+		if u.Scheme != "https" && u.Scheme != "http" {
+			return errors.New("media url must be http or https")
+		}
+	}
+	switch kind {
+	case KindImage:
+		if c.Mime != "" && !strings.HasPrefix(c.Mime, "image/") {
+			return fmt.Errorf("%s is not an image type", c.Mime)
+		}
+	case KindAudio:
+		if c.Mime != "" && !strings.HasPrefix(c.Mime, "audio/") {
+			return fmt.Errorf("%s is not an audio type", c.Mime)
+		}
+	}
+	if c.Size < 0 || c.Width < 0 || c.Height < 0 || c.Duration < 0 {
+		return errors.New("media dimensions cannot be negative")
+	}
+	if utf8.RuneCountInString(c.Name) > maxNameLength {
+		return fmt.Errorf("file name is longer than %d characters", maxNameLength)
+	}
+	if utf8.RuneCountInString(c.Caption) > maxCaptionLength {
+		return fmt.Errorf("caption is longer than %d characters", maxCaptionLength)
+	}
+	return nil
+}
+
+func (c *LocationContent) validate() error {
+	if c.Latitude < -90 || c.Latitude > 90 {
+		return errors.New("latitude must be between -90 and 90")
+	}
+	if c.Longitude < -180 || c.Longitude > 180 {
+		return errors.New("longitude must be between -180 and 180")
+	}
+	if utf8.RuneCountInString(c.Name) > maxNameLength || utf8.RuneCountInString(c.Address) > maxNameLength {
+		return fmt.Errorf("location names are limited to %d characters", maxNameLength)
+	}
+	return nil
+}
+
+func (c *ContactContent) validate() error {
+	if strings.TrimSpace(c.Name) == "" {
+		return errors.New("contact name is empty")
+	}
+	if utf8.RuneCountInString(c.Name) > maxNameLength {
+		return fmt.Errorf("contact name is longer than %d characters", maxNameLength)
+	}
+	if len(c.Phones) > maxContactFields || len(c.Emails) > maxContactFields {
+		return fmt.Errorf("contacts carry at most %d phones and emails", maxContactFields)
+	}
+	if len(c.Phones) == 0 && len(c.Emails) == 0 {
+		return errors.New("contact needs a phone number or an email")
+	}
+	for _, phone := range c.Phones {
+		if strings.Trim(phone, "+0123456789 -()") != "" || !strings.ContainsAny(phone, "0123456789") {
+			return fmt.Errorf("%q is not a phone number", phone)
+		}
+	}
+	for _, email := range c.Emails {
+		if _, err := mail.ParseAddress(email); err != nil {
+			return fmt.Errorf("%q is not an email address", email)
+		}
+	}
+	return nil
+}
+
+// Summary is the plain text stand-in for the content. It is stored as the
+// message data so that older clients and quotes still show something useful.
+func (c *MessageContent) Summary() string {
+	switch c.Kind {
+	case KindText:
+		return c.Text.Body
+	case KindImage:
+		return orDefault(c.Media.Caption, "📷 Photo")
+	case KindFile:
+		return orDefault(c.Media.Caption, "📄 "+orDefault(c.Media.Name, "File"))
+	case KindAudio:
+		return orDefault(c.Media.Caption, "🎤 Audio "+formatDuration(c.Media.Duration))
+	case KindLocation:
+		return "📍 " + orDefault(c.Location.Name, "Location")
+	case KindContact:
+		return "👤 " + c.Contact.Name
+	}
+	return ""
+}
+
+func (c *MessageContent) renderHints() *RenderHints {
+	hints := &RenderHints{
+		Preview: truncate(c.Summary(), previewLength),
+	}
+	switch c.Kind {
+	case KindText:
+		hints.Layout = "text"
+	case KindImage:
+		hints.Layout = "media"
+		hints.Icon = "image"
+		if c.Media.Width > 0 && c.Media.Height > 0 {
+			hints.AspectRatio = float64(c.Media.Width) / float64(c.Media.Height)
+		}
+	case KindFile:
+		hints.Layout = "file"
+		hints.Icon = "file"
+	case KindAudio:
+		hints.Layout = "audio"
+		hints.Icon = "audio"
+	case KindLocation:
+		hints.Layout = "map"
+		hints.Icon = "location"
+	case KindContact:
+		hints.Layout = "card"
+		hints.Icon = "contact"
+	}
+	return hints
+}
+
+func orDefault(s, fallback string) string {
+	if strings.TrimSpace(s) == "" {
+		return fallback
+	}
+	return s
+}
+
+func formatDuration(seconds float64) string {
+	total := int(seconds + 0.5)
+	return fmt.Sprintf("%d:%02d", total/60, total%60)
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "…"
+}
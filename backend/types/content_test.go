@@ -0,0 +1,40 @@
+package types
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContactValidate(t *testing.T) {
+	contact := func(phones, emails []string) *MessageContent {
+		return &MessageContent{Kind: KindContact, Contact: &ContactContent{
+			Name:   "Alice",
+			Phones: phones,
+			Emails: emails,
+		}}
+	}
+	valid := []*MessageContent{
+		contact([]string{"+1 (555) 010-0199"}, nil),
+		contact(nil, []string{"alice@example.com"}),
+		contact([]string{"555 0100"}, []string{"alice@example.com"}),
+	}
+	for _, c := range valid {
+		if err := c.Validate(); err != nil {
+			t.Errorf("%+v: %v", c.Contact, err)
+		}
+	}
+	invalid := map[string]*MessageContent{
+		"no phone or email": contact(nil, nil),
+		"empty phone":       contact([]string{""}, nil),
+		"blank phone":       contact([]string{"   "}, nil),
+		"no digits":         contact([]string{"+ -()"}, nil),
+		"letters":           contact([]string{"call me"}, nil),
+		"bad email":         contact(nil, []string{"alice"}),
+		"too many phones":   contact(strings.Fields(strings.Repeat("555 ", maxContactFields+1)), nil),
+	}
+	for name, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%s: accepted %+v", name, c.Contact)
+		}
+	}
+}
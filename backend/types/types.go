@@ -1,6 +1,10 @@
 package types
 
 import (
+	"encoding/json"
+	"fmt"
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -10,28 +14,443 @@ type Chats struct {
 	Group        bool                 `json:"group"`
 	Participants []primitive.ObjectID `json:"participants"`
 	Messages     []primitive.ObjectID `json:"messages"`
+	Admins       []primitive.ObjectID `bson:"admins,omitempty" json:"admins,omitempty"`
+	Pinned       []PinnedMessage      `bson:"pinned,omitempty" json:"pinned,omitempty"`
+	// Groups get a generated avatar until an admin uploads one.
+	Avatar            string         `bson:"avatar,omitempty" json:"avatar,omitempty"`
+	AvatarSizes       []ImageVariant `bson:"avatarsizes,omitempty" json:"avatarSizes,omitempty"`
+	AvatarGenerated   bool           `bson:"avatargenerated,omitempty" json:"avatarGenerated,omitempty"`
+	AvatarPlaceholder *Placeholder   `bson:"avatarplaceholder,omitempty" json:"avatarPlaceholder,omitempty"`
+}
+
+type PinnedMessage struct {
+	MessageId primitive.ObjectID `json:"messageId"`
+	PinnedBy  primitive.ObjectID `json:"pinnedBy"`
+	PinnedAt  string             `json:"pinnedAt"`
+}
+
+func (c *Chats) HasParticipant(id primitive.ObjectID) bool {
+	for _, p := range c.Participants {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Chats) IsAdmin(id primitive.ObjectID) bool {
+	for _, a := range c.Admins {
+		if a == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Chats) IsPinned(msgId primitive.ObjectID) bool {
+	for _, p := range c.Pinned {
+		if p.MessageId == msgId {
+			return true
+		}
+	}
+	return false
 }
 
 type Message struct {
-	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	ID          primitive.ObjectID   `bson:"_id,omitempty" json:"id,omitempty"`
+	Data        string               `json:"data"`
+	Content     *MessageContent      `bson:"content,omitempty" json:"content"`
+	Attachments []Attachment         `bson:"attachments,omitempty" json:"attachments,omitempty"`
+	ArrivalTime string               `json:"arrivalTime"`
+	From        primitive.ObjectID   `json:"from"`
+	ChatId      primitive.ObjectID   `json:"chatid"`
+	To          primitive.ObjectID   `json:"to"`
+	ReplyTo     *primitive.ObjectID  `bson:"replyto,omitempty" json:"replyTo,omitempty"`
+	ThreadId    *primitive.ObjectID  `bson:"threadid,omitempty" json:"threadId,omitempty"`
+	ReadBy      []primitive.ObjectID `bson:"readby,omitempty" json:"-"`
+	Reactions   []Reaction           `bson:"reactions,omitempty" json:"reactions,omitempty"`
+	Forwarded   bool                 `bson:"forwarded,omitempty" json:"forwarded,omitempty"`
+	Origin      *ForwardOrigin       `bson:"origin,omitempty" json:"origin,omitempty"`
+	Forwards    int                  `bson:"forwards,omitempty" json:"forwards,omitempty"`
+	System      bool                 `bson:"system,omitempty" json:"system,omitempty"`
+	Mentions    []Mention            `bson:"mentions,omitempty" json:"mentions,omitempty"`
+	MentionAll  bool                 `bson:"mentionall,omitempty" json:"mentionAll,omitempty"`
+	Quote       *QuotedMessage       `bson:"-" json:"quote,omitempty"`
+}
+
+// Mention is an @name reference to a participant inside the message text.
+// Offset and Length count characters, not bytes, and cover the leading @.
+type Mention struct {
+	UserId primitive.ObjectID `json:"userId"`
+	Offset int                `json:"offset"`
+	Length int                `json:"length"`
+}
+
+// ForwardOrigin points a forwarded copy back at the message it was
+// originally sent as, however many times it has been forwarded since.
+type ForwardOrigin struct {
+	MessageId primitive.ObjectID `json:"messageId"`
+	ChatId    primitive.ObjectID `json:"chatid"`
+	From      primitive.ObjectID `json:"from"`
+}
+
+// Reaction groups everyone who reacted to a message with the same emoji.
+type Reaction struct {
+	Emoji string               `json:"emoji"`
+	Users []primitive.ObjectID `json:"users"`
+}
+
+func (r Reaction) MarshalJSON() ([]byte, error) {
+	type reaction Reaction
+	return json.Marshal(struct {
+		reaction
+		Count int `json:"count"`
+	}{reaction(r), len(r.Users)})
+}
+
+// MarshalJSON always presents typed content with its render hints. Messages
+// stored before typed content existed are shown as text.
+func (m Message) MarshalJSON() ([]byte, error) {
+	type message Message
+	out := message(m)
+	content := TextMessageContent(m.Data)
+	if m.Content != nil {
+		copied := *m.Content
+		content = &copied
+	}
+	if content.Media != nil && content.Media.AttachmentId != nil && content.Media.URL == "" {
+		if a := m.AttachmentById(*content.Media.AttachmentId); a == nil || a.Available() {
+			media := *content.Media
+			media.URL = AttachmentURL(m.ChatId, *media.AttachmentId)
+			content.Media = &media
+		}
+	}
+	content.Render = content.renderHints()
+	out.Content = content
+	out.Attachments = make([]Attachment, len(m.Attachments))
+	for i, a := range m.Attachments {
+		if !a.Available() {
+			out.Attachments[i] = a
+			continue
+		}
+		if a.URL == "" {
+			a.URL = AttachmentURL(m.ChatId, a.ID)
+		}
+		a.Variants = make([]ImageVariant, len(a.Variants))
+		for j, v := range m.Attachments[i].Variants {
+			if v.URL == "" {
+				v.URL = AttachmentURL(m.ChatId, a.ID) + "?variant=" + v.Name
+			}
+			a.Variants[j] = v
+		}
+		out.Attachments[i] = a
+	}
+	return json.Marshal(out)
+}
+
+// Attachment is a file uploaded into a chat. The stored file is only served
+// to participants, through a signed link or the URL returned by
+// AttachmentURL.
+type Attachment struct {
+	ID          primitive.ObjectID `json:"id"`
+	Name        string             `json:"name"`
+	Mime        string             `json:"mime"`
+	Size        int64              `json:"size"`
+	Hash        string             `json:"hash"`
+	Width       int                `bson:"width,omitempty" json:"width,omitempty"`
+	Height      int                `bson:"height,omitempty" json:"height,omitempty"`
+	Duration    float64            `bson:"duration,omitempty" json:"duration,omitempty"`
+	Variants    []ImageVariant     `bson:"variants,omitempty" json:"variants,omitempty"`
+	Placeholder *Placeholder       `bson:"placeholder,omitempty" json:"placeholder,omitempty"`
+	Status      string             `bson:"status,omitempty" json:"status,omitempty"`
+	Threat      string             `bson:"threat,omitempty" json:"threat,omitempty"`
+	Path        string             `json:"-"`
+	URL         string             `bson:"-" json:"url,omitempty"`
+}
+
+// Attachments start out pending until the malware scan clears or blocks
+// them. Files over the scanner's size limit stay unscanned: they are kept
+// but, like pending ones, only their sender sees them. Attachments stored
+// before scanning existed have no status and count as clean.
+const (
+	AttachmentPending   = "pending"
+	AttachmentClean     = "clean"
+	AttachmentBlocked   = "blocked"
+	AttachmentUnscanned = "unscanned"
+)
+
+// Available reports whether the attachment passed its scan and may be shown
+// to everyone in the chat.
+func (a Attachment) Available() bool {
+	return a.Status == "" || a.Status == AttachmentClean
+}
+
+// AttachmentById returns the attachment of m with the given id.
+func (m *Message) AttachmentById(id primitive.ObjectID) *Attachment {
+	for i := range m.Attachments {
+		if m.Attachments[i].ID == id {
+			return &m.Attachments[i]
+		}
+	}
+	return nil
+}
+
+// Placeholder describes an image well enough for clients to paint
+// something while it loads: a blurhash (https://blurha.sh) and the
+// dominant colour as #rrggbb.
+type Placeholder struct {
+	BlurHash string `json:"blurhash"`
+	Color    string `json:"color"`
+}
+
+// Avatar is a stored profile picture or group avatar. URL is the location
+// of the largest size.
+type Avatar struct {
+	URL         string
+	Sizes       []ImageVariant
+	Placeholder *Placeholder
+	Generated   bool
+}
+
+// ImageVariant is a resized rendition of an uploaded image.
+type ImageVariant struct {
+	Name   string `json:"name"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Path   string `json:"-"`
+	URL    string `json:"url"`
+}
+
+func AttachmentURL(chatId, attachmentId primitive.ObjectID) string {
+	return fmt.Sprintf("/api/chat/%s/attachments/%s", chatId.Hex(), attachmentId.Hex())
+}
+
+// QuotedMessage is the preview of the parent message embedded in replies.
+// It is filled in when messages are read and never stored.
+type QuotedMessage struct {
+	ID          primitive.ObjectID `json:"id"`
+	From        primitive.ObjectID `json:"from"`
 	Data        string             `json:"data"`
 	ArrivalTime string             `json:"arrivalTime"`
-	From        primitive.ObjectID `json:"from"`
-	ChatId      primitive.ObjectID `json:"chatid"`
-	To          primitive.ObjectID `json:"to"`
+}
+
+type Thread struct {
+	Root    *Message  `json:"root"`
+	Replies []Message `json:"replies"`
+	Unread  int64     `json:"unread"`
 }
 
 type TempUser struct {
 	Email    string
 	Password string
+	// Device optionally names the device logging in, e.g. "Work laptop".
+	Device string
 }
 
 type MongoUser struct {
-	ID        primitive.ObjectID   `bson:"_id,omitempty" json:"id,omitempty"`
-	Email     string               `json:"email"`
-	Name      string               `json:"name"`
-	Password  string               `json:"-"`
-	Pfp       string               `json:"pfp"`
-	CreatedAt string               `json:"createdAt"`
-	Chats     []primitive.ObjectID `json:"chats"`
+	ID             primitive.ObjectID   `bson:"_id,omitempty" json:"id,omitempty"`
+	Email          string               `json:"email"`
+	Name           string               `json:"name"`
+	Password       string               `json:"-"`
+	Pfp            string               `json:"pfp"`
+	PfpSizes       []ImageVariant       `bson:"pfpsizes,omitempty" json:"pfpSizes,omitempty"`
+	PfpGenerated   bool                 `bson:"pfpgenerated,omitempty" json:"pfpGenerated,omitempty"`
+	PfpPlaceholder *Placeholder         `bson:"pfpplaceholder,omitempty" json:"pfpPlaceholder,omitempty"`
+	CreatedAt      string               `json:"createdAt"`
+	Chats          []primitive.ObjectID `json:"chats"`
+	Muted          []primitive.ObjectID `bson:"muted,omitempty" json:"muted,omitempty"`
+	Unverified     bool                 `bson:"unverified,omitempty" json:"unverified,omitempty"`
+	TwoFactor      *TwoFactor           `bson:"twofactor,omitempty" json:"-"`
+	Passkeys       []Passkey            `bson:"passkeys,omitempty" json:"-"`
+	Identities     []Identity           `bson:"identities,omitempty" json:"-"`
+}
+
+// TwoFactor holds a user's authenticator app enrollment. Pending is the
+// secret being set up until the first code confirms it.
+type TwoFactor struct {
+	Secret   string `bson:"secret,omitempty"`
+	Pending  string `bson:"pending,omitempty"`
+	Enabled  bool
+	LastStep int64
+	// RecoveryCodes are hashes of the unused recovery codes.
+	RecoveryCodes []string
+}
+
+func (u *MongoUser) TwoFactorEnabled() bool {
+	return u.TwoFactor != nil && u.TwoFactor.Enabled
+}
+
+func (u *MongoUser) HasMuted(chatId primitive.ObjectID) bool {
+	for _, c := range u.Muted {
+		if c == chatId {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is pushed to connected clients over the websocket.
+type Event struct {
+	Type     string `json:"type"`
+	Priority string `json:"priority,omitempty"`
+	Data     any    `json:"data"`
+}
+
+// Upload tracks a resumable upload. The bytes received so far live in the
+// blob store as one object per chunk until the upload completes.
+type Upload struct {
+	ID        primitive.ObjectID  `bson:"_id,omitempty" json:"id,omitempty"`
+	UserId    primitive.ObjectID  `json:"userId"`
+	ChatId    primitive.ObjectID  `json:"chatid"`
+	Filename  string              `json:"filename"`
+	Caption   string              `json:"caption,omitempty"`
+	Length    int64               `json:"length"`
+	Offset    int64               `json:"offset"`
+	Chunks    []UploadChunk       `json:"-"`
+	ExpiresAt time.Time           `json:"expiresAt"`
+	MessageId *primitive.ObjectID `bson:"messageid,omitempty" json:"messageId,omitempty"`
+}
+
+type UploadChunk struct {
+	Key    string
+	Offset int64
+	Size   int64
+}
+
+// Blob is a stored file shared by every message, user and group that
+// uploaded the same bytes. Refs names its owners, like "message:<id>"; the
+// file is deleted together with its last reference.
+type Blob struct {
+	Key       string   `bson:"_id" json:"key"`
+	Hash      string   `json:"hash"`
+	Mime      string   `json:"mime"`
+	Size      int64    `json:"size"`
+	URL       string   `json:"url"`
+	Refs      []string `json:"refs"`
+	CreatedAt string   `json:"createdAt"`
+	// Ready is set once the file is uploaded. Until then the record may
+	// be referenced while the file is still missing.
+	Ready bool `bson:"ready,omitempty" json:"ready"`
+	// DeletingAt marks a blob whose last reference went and whose file is
+	// being deleted. It cannot be referenced again until the record is gone.
+	DeletingAt *time.Time `bson:"deletingat,omitempty" json:"deletingAt,omitempty"`
+}
+
+// RefreshToken is one link in the chain of refresh tokens issued for a
+// login. Rotated tokens share their Family; only a hash of the token is
+// stored.
+type RefreshToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserId    primitive.ObjectID
+	Family    primitive.ObjectID
+	Hash      string
+	ExpiresAt time.Time
+	Used      bool
+	Revoked   bool
+	CreatedAt time.Time
+}
+
+// RevokedSession marks a login as ended. Access tokens of the session are
+// refused until Until, by which time they have all expired anyway.
+type RevokedSession struct {
+	ID     primitive.ObjectID `bson:"_id"`
+	UserId primitive.ObjectID
+	Until  time.Time
+}
+
+// Session is one login of a user. Its id is the family of the tokens
+// issued for it.
+type Session struct {
+	ID         primitive.ObjectID `bson:"_id" json:"id"`
+	UserId     primitive.ObjectID `json:"-"`
+	Device     string             `json:"device"`
+	UserAgent  string             `json:"userAgent"`
+	IP         string             `json:"ip"`
+	CreatedAt  time.Time          `json:"createdAt"`
+	LastActive time.Time          `json:"lastActive"`
+	ExpiresAt  time.Time          `json:"expiresAt"`
+	Revoked    bool               `json:"-"`
+	Current    bool               `bson:"-" json:"current"`
+}
+
+const (
+	EmailVerification = "verify"
+	PasswordReset     = "reset"
+)
+
+// EmailToken is a single use token sent to a user's address, e.g. to
+// verify it. Only a hash of the token is stored.
+type EmailToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserId    primitive.ObjectID
+	Purpose   string
+	Hash      string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// LoginChallenge is a login waiting for its second factor. Only a hash of
+// the challenge token is stored.
+type LoginChallenge struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserId    primitive.ObjectID
+	Hash      string
+	Device    string
+	Attempts  int
+	ExpiresAt time.Time
+}
+
+// Passkey is a WebAuthn credential a user can log in with. ID is the
+// credential id the authenticator chose.
+type Passkey struct {
+	ID              []byte
+	Name            string
+	PublicKey       []byte
+	AttestationType string
+	Transports      []string
+	// Flags are the authenticator flags seen at registration.
+	Flags     byte
+	AAGUID    []byte
+	SignCount uint32
+	CreatedAt time.Time
+	LastUsed  time.Time `bson:"lastused,omitempty"`
+}
+
+const (
+	PasskeyRegistration = "register"
+	PasskeyLogin        = "login"
+)
+
+// PasskeyCeremony keeps the state of a WebAuthn registration or login
+// between its two requests. Session is the library's session data as
+// JSON; only a hash of the ceremony token is stored.
+type PasskeyCeremony struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserId    primitive.ObjectID `bson:"userid,omitempty"`
+	Purpose   string
+	Hash      string
+	Session   []byte
+	Device    string
+	ExpiresAt time.Time
+}
+
+// Identity is an account at an OpenID Connect provider that can log in
+// as the user.
+type Identity struct {
+	Provider string
+	Subject  string
+	Email    string
+	LinkedAt time.Time
+}
+
+// OIDCState remembers a login sent to a provider until it comes back.
+// Only a hash of the state is stored.
+type OIDCState struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Hash      string
+	Provider  string
+	Nonce     string
+	Verifier  string
+	Device    string
+	ExpiresAt time.Time
 }